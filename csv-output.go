@@ -0,0 +1,100 @@
+package main
+// vim: set et sw=4 :
+
+import (
+    "context"
+    "encoding/csv"
+    "math"
+    "net/http"
+    "strconv"
+
+    "github.com/ebikt/ethtool-exporter/sff8472"
+)
+
+// csvMetricColumns follow iface, error and tag columns, power is in unit of -power-unit besides W
+func csvMetricColumns(power powerUnit) []string {
+    return []string{"temperature_C", "voltage_V", "bias_A", "receive_power_" + power.field, "transmit_power_" + power.field, "receive_power_W", "transmit_power_W"}
+}
+
+// CSVChan emits one row per interface, see csvHeader for columns
+type CSVChan struct {
+    ch    chan<- []string
+    done  <-chan struct{}
+    power powerUnit
+}
+
+func csvHeader(power powerUnit) []string {
+    return append(append([]string{"iface", "error"}, transcieverTags()...), csvMetricColumns(power)...)
+}
+
+// csvFloat formats value, non-finite ones (i.e. -Inf dBm of dark receiver) are left empty
+func csvFloat(value float64) string {
+    if math.IsInf(value, 0) || math.IsNaN(value) {
+        return ""
+    }
+    return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+func (cc CSVChan) Emit(iface string, err error, tags map[string]string, metrics *sff8472.TranscieverDiagnostics, link *LinkInfo) {
+    row := []string{iface, ""}
+    if err != nil {
+        row[1] = err.Error()
+    }
+    for _, label := range(transcieverTags()) {
+        row = append(row, tags[label])
+    }
+    if err == nil && metrics != nil {
+        // monitors not provided by diagnostics source are left empty
+        monitor := func(monitor int, value float64) string {
+            if !metrics.Has(monitor) {
+                return ""
+            }
+            return csvFloat(value)
+        }
+        row = append(row,
+            csvFloat(metrics.TemperatureC),
+            monitor(sff8472.DIAG_VOLTAGE,  metrics.VoltageV),
+            monitor(sff8472.DIAG_BIAS,     metrics.BiasMA * 0.001),
+            monitor(sff8472.DIAG_RX_POWER, cc.power.Field(metrics.ReceiveMW)),
+            monitor(sff8472.DIAG_TX_POWER, cc.power.Field(metrics.TransmitMW)),
+            monitor(sff8472.DIAG_RX_POWER, metrics.ReceiveMW * 0.001),
+            monitor(sff8472.DIAG_TX_POWER, metrics.TransmitMW * 0.001),
+        )
+    } else {
+        row = append(row, make([]string, len(csvMetricColumns(cc.power)))...)
+    }
+    select {
+        case cc.ch <- row:
+        case <-cc.done:
+    }
+}
+
+// CSVHandler returns header row and one row per interface, for spreadsheet import
+func (e *Exporter) CSVHandler() (func(http.ResponseWriter, *http.Request)) {
+    return func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+        writer, closer := compressedWriter(w, r)
+        defer closer()
+        ctx, cancel := context.WithCancel(r.Context())
+        defer cancel()
+
+        rows := make(chan []string)
+        go func () {
+            defer close(rows)
+            e.CollectTo(ctx, CSVChan{ ch: rows, done: ctx.Done(), power: e.powerUnit })
+        } ()
+
+        out := csv.NewWriter(writer)
+        out.Write(csvHeader(e.powerUnit))
+        for row := range(rows) {
+            if ctx.Err() != nil {
+                // client is gone, just drain the channel until collection stops
+                continue
+            }
+            if err := out.Write(row); err != nil {
+                cancel()
+            }
+        }
+        out.Flush()
+    }
+}
@@ -0,0 +1,84 @@
+package main
+// vim: set et sw=4 :
+
+import (
+    "strings"
+    "sync"
+
+    "github.com/ebikt/ethtool-exporter/sff8472"
+)
+
+// ScrapeDiagCache shares diagnostics of one optic among its logical interfaces (i.e. breakout ports)
+// within single scrape, so that they are read only once. Optics are identified by serial number together
+// with vendor, product and OUI (and hash of identity EEPROM area when it is read), as serials may collide.
+type ScrapeDiagCache struct {
+    mutex sync.Mutex
+    diags map[string]scrapeDiag
+}
+
+type scrapeDiag struct {
+    metrics *sff8472.TranscieverDiagnostics
+    reason  string // DdmUnavailableReason
+}
+
+// NewScrapeDiagCache returns nil, that is no caching, when serials are not unique (-no-cache)
+func NewScrapeDiagCache() *ScrapeDiagCache {
+    if sff8472.ModuleCacheDisabled {
+        return nil
+    }
+    return &ScrapeDiagCache{ diags: make(map[string]scrapeDiag) }
+}
+
+// diagReader is part of sff8472.EthToolModule used by ScrapeDiagCache
+type diagReader interface {
+    TxrDiag() (*sff8472.TranscieverDiagnostics, error)
+    DdmUnavailableReason() string
+    Abandoned() error
+}
+
+// copyDiag returns shallow copy, as collectIface adds line side monitors to its diagnostics
+func copyDiag(metrics *sff8472.TranscieverDiagnostics) *sff8472.TranscieverDiagnostics {
+    if metrics == nil {
+        return nil
+    }
+    ret := *metrics
+    return &ret
+}
+
+// DiagCacheKey identifies optic by module info tags, that are already read (or cached) by ModuleInfo,
+// and by identity hash, that may be empty when it is not read. Optic without valid serial has no key.
+func DiagCacheKey(tags map[string]string, hash string) string {
+    if !sff8472.ValidSerial(tags["serial"]) {
+        return ""
+    }
+    return strings.Join([]string{ tags["serial"], tags["vendor"], tags["product"], tags["oui"], hash }, "\x00")
+}
+
+// TxrDiag returns diagnostics of module and reason why they are unavailable, only the first
+// interface with given key (see DiagCacheKey) reads them. Empty key is not cached.
+// Errors are not cached.
+func (c *ScrapeDiagCache) TxrDiag(m diagReader, key string) (*sff8472.TranscieverDiagnostics, string, error) {
+    if c == nil || key == "" {
+        metrics, err := m.TxrDiag()
+        return metrics, m.DdmUnavailableReason(), err
+    }
+    c.mutex.Lock()
+    cached, found := c.diags[key]
+    c.mutex.Unlock()
+    if found {
+        return copyDiag(cached.metrics), cached.reason, nil
+    }
+    metrics, err := m.TxrDiag()
+    if err != nil {
+        return nil, "", err
+    }
+    if err := m.Abandoned(); err != nil {
+        // diagnostics read by abandoned collection are thrown away
+        return nil, "", err
+    }
+    reason := m.DdmUnavailableReason()
+    c.mutex.Lock()
+    c.diags[key] = scrapeDiag{ metrics: copyDiag(metrics), reason: reason }
+    c.mutex.Unlock()
+    return metrics, reason, nil
+}
@@ -0,0 +1,37 @@
+package main
+// vim: set et sw=4 :
+
+import (
+    "sync"
+)
+
+// EepromHashes remembers hash of identity EEPROM area of each optic (by serial) when
+// it was seen for the first time, so that re-flashed optic or another optic with the same
+// serial can be detected.
+type EepromHashes struct {
+    mutex  sync.Mutex
+    hashes map[string]string
+}
+
+func NewEepromHashes() *EepromHashes {
+    return &EepromHashes{ hashes: make(map[string]string) }
+}
+
+// Flush forgets all hashes, next one seen for each serial becomes the reference
+func (h *EepromHashes) Flush() {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+    h.hashes = make(map[string]string)
+}
+
+// Changed records hash for serial if it is new and reports whether it differs from the first one
+func (h *EepromHashes) Changed(serial string, hash string) bool {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+    first, found := h.hashes[serial]
+    if !found {
+        h.hashes[serial] = hash
+        return false
+    }
+    return first != hash
+}
@@ -0,0 +1,53 @@
+package main
+// vim: set et sw=4 :
+
+import (
+    "sync"
+    "time"
+)
+
+// EmptyCages remembers interfaces whose module could not be opened (i.e. empty cage), so that
+// ioctl is not repeated on every scrape. Entries expire after ttl, so inserted optic is detected then.
+type EmptyCages struct {
+    mutex  sync.Mutex
+    ttl    time.Duration
+    cages  map[string]emptyCage
+}
+
+type emptyCage struct {
+    err   error
+    until time.Time
+}
+
+func NewEmptyCages(ttl time.Duration) *EmptyCages {
+    return &EmptyCages{ ttl: ttl, cages: make(map[string]emptyCage) }
+}
+
+// Flush forgets all empty cages, they are probed again on next scrape
+func (c *EmptyCages) Flush() {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    c.cages = make(map[string]emptyCage)
+}
+
+// Put remembers error of opening module of interface
+func (c *EmptyCages) Put(iface string, err error) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    c.cages[iface] = emptyCage{ err: err, until: time.Now().Add(c.ttl) }
+}
+
+// Get returns remembered error of interface, unless it has expired
+func (c *EmptyCages) Get(iface string) (error, bool) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    cage, found := c.cages[iface]
+    if !found {
+        return nil, false
+    }
+    if time.Now().After(cage.until) {
+        delete(c.cages, iface)
+        return nil, false
+    }
+    return cage.err, true
+}
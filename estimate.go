@@ -0,0 +1,144 @@
+package main
+// vim: set et sw=4 :
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "strings"
+    "time"
+
+    "github.com/ebikt/ethtool-exporter/sff8472"
+)
+
+// scrapeCost is number of ioctls and EEPROM reads (which are spaced by -read-interval) of one scrape,
+// and number of interfaces whose diagnostics are read from hwmon sysfs (without ioctls)
+type scrapeCost struct {
+    ioctls int
+    reads  int
+    hwmon  int
+}
+
+func (c scrapeCost) duration(latency, readInterval time.Duration) time.Duration {
+    return time.Duration(c.ioctls) * latency + time.Duration(c.reads) * readInterval
+}
+
+func (c *scrapeCost) add(o scrapeCost) {
+    c.ioctls += o.ioctls
+    c.reads  += o.reads
+    c.hwmon  += o.hwmon
+}
+
+// estimateIface returns cost of the first scrape of interface and of scrapes that find module info in cache.
+// Reads are counted by the same predicates as collectIface uses, module is assumed to have valid serial
+// and digital diagnostics. Opening the module (single ETHTOOL_GMODULEINFO ioctl) is timed as ioctl latency.
+func (e *Exporter) estimateIface(writer io.Writer, iface string) (scrapeCost, scrapeCost, time.Duration) {
+    var link int
+    if e.collectLink {
+        link = 1
+    }
+    start := time.Now()
+    m, err := sff8472.NewEthToolModule(iface)
+    latency := time.Since(start)
+    if err != nil {
+        fmt.Fprintf(writer, "%s\tno module: %v\n", iface, err)
+        cost := scrapeCost{ ioctls: 1 + link }
+        if e.readsHwmon(err) {
+            cost.hwmon = 1
+        }
+        return cost, cost, latency
+    }
+    first, cached, err := m.ReadPlan(e.txrInfoFlags)
+    if e.unsupportedAsPresent && errors.Is(err, sff8472.ErrUnsupportedModule) {
+        base := m.BaseIdentityPlan()
+        first  = append(first, base...)
+        cached = append(cached, base...)
+        err = nil
+    }
+    var other []string // reads of every scrape beyond module info
+    if err == nil && e.readsIdentityHash(true) {
+        other = append(other, "identity_hash")
+    }
+    diag := 0
+    if err == nil && e.readsTxrDiag("") {
+        diag = m.DiagReads()
+    }
+    hwmon := 0
+    if e.readsHwmon(err) {
+        hwmon = 1
+    }
+    if e.lineSideOffset > 0 && m.DiagReads() > 0 && (diag > 0 || hwmon > 0) {
+        diag++
+    }
+    // GMODULEINFO, module info reads, identity hash, diagnostics, link settings
+    reads := len(other) + diag
+    firstCost  := scrapeCost{ ioctls: 1 + len(first) + reads + link, reads: len(first) + reads, hwmon: hwmon }
+    cachedCost := scrapeCost{ ioctls: 1 + len(cached) + reads + link, reads: len(cached) + reads, hwmon: hwmon }
+    if err != nil {
+        fmt.Fprintf(writer, "%s\tmodule type %d: %v, %d ioctls\n", iface, m.Type(), err, firstCost.ioctls)
+    } else {
+        fmt.Fprintf(writer, "%s\tmodule type %d, first scrape %d ioctls (module info %s), then %d ioctls (%s), %d diagnostic reads\n",
+                    iface, m.Type(), firstCost.ioctls, strings.Join(first, " "), cachedCost.ioctls, strings.Join(cached, " "), diag)
+    }
+    if len(other) > 0 {
+        fmt.Fprintf(writer, "%s\tevery scrape also reads %s\n", iface, strings.Join(other, " "))
+    }
+    if hwmon > 0 {
+        fmt.Fprintf(writer, "%s\tdiagnostics from hwmon sysfs\n", iface)
+    }
+    return firstCost, cachedCost, latency
+}
+
+// Estimate prints number of ioctls and rough duration of scrape of ifaces, without reading diagnostics
+func (e *Exporter) Estimate(writer io.Writer, ifaces []string) {
+    groups := e.serialGroups(ifaces)
+    var latency time.Duration
+    var firstGroups, cachedGroups []scrapeCost
+    var firstTotal, cachedTotal scrapeCost
+    for i, group := range(groups) {
+        fmt.Fprintf(writer, "Serial group %d:\n", i + 1)
+        var firstGroup, cachedGroup scrapeCost
+        for _, iface := range(group) {
+            first, cached, ifaceLatency := e.estimateIface(writer, iface)
+            if ifaceLatency > latency {
+                latency = ifaceLatency
+            }
+            firstGroup.add(first)
+            cachedGroup.add(cached)
+        }
+        firstGroups  = append(firstGroups, firstGroup)
+        cachedGroups = append(cachedGroups, cachedGroup)
+        firstTotal.add(firstGroup)
+        cachedTotal.add(cachedGroup)
+    }
+    slots := len(groups)
+    limit := "unlimited"
+    if e.limiter.slots != nil && cap(e.limiter.slots) < slots {
+        slots = cap(e.limiter.slots)
+    }
+    if e.limiter.slots != nil {
+        limit = fmt.Sprintf("%d", cap(e.limiter.slots))
+    }
+    // scrape takes at least as long as the slowest group and as total work divided among parallel slots
+    duration := func(groups []scrapeCost, total scrapeCost) time.Duration {
+        var ret time.Duration
+        for _, group := range(groups) {
+            if d := group.duration(latency, e.readInterval); d > ret {
+                ret = d
+            }
+        }
+        if slots > 0 {
+            if d := total.duration(latency, e.readInterval) / time.Duration(slots); d > ret {
+                ret = d
+            }
+        }
+        return ret
+    }
+    fmt.Fprintf(writer, "%d interfaces in %d serial groups, max parallel %s, slowest ioctl %v, read interval %v\n",
+                len(ifaces), len(groups), limit, latency, e.readInterval)
+    fmt.Fprintf(writer, "First scrape: %d ioctls, ~%v\n", firstTotal.ioctls, duration(firstGroups, firstTotal))
+    fmt.Fprintf(writer, "Next scrapes: %d ioctls, ~%v\n", cachedTotal.ioctls, duration(cachedGroups, cachedTotal))
+    if cachedTotal.hwmon > 0 {
+        fmt.Fprintf(writer, "Diagnostics of %d interfaces are read from hwmon sysfs, not included above\n", cachedTotal.hwmon)
+    }
+}
@@ -2,149 +2,1036 @@ package main
 // vim: set et sw=4 :
 
 import (
+    "compress/gzip"
+    "context"
+    "errors"
+    "encoding/hex"
     "flag"
     "fmt"
     "io"
+    "io/ioutil"
+    "math"
+    "net"
     "net/http"
+    "net/http/pprof"
     "regexp"
     "os"
+    "os/signal"
     "path/filepath"
     "sort"
+    "strconv"
     "strings"
     "sync"
+    "sync/atomic"
+    "syscall"
     "time"
+    "unicode/utf8"
 
+    "github.com/ebikt/ethtool-exporter/sff8472"
     "github.com/mpvl/unique"
     "github.com/prometheus/common/expfmt"
     "github.com/prometheus/common/version"
     "github.com/prometheus/client_golang/prometheus"
-    "github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // {{{ prometheus vars
 const namespace = "ethtool"
 
-// transcieverFullLabels[2:] are names of tags obtained by EthToolModule.ModuleInfo()
+// transcieverFullLabels[2:] are names of tags obtained by sff8472.EthToolModule.ModuleInfo(), labels of transciever_present
 var transcieverFullLabels = []string{"iface","error","vendor","revision","product","serial","wavelen","mfgdate"}
+// transcieverExtraTags are tags of influx, JSON, statsd and CSV output that are not labels of transciever_present,
+// as they may change between scrapes or describe interface rather than optic. Prometheus exports them
+// by separate metrics or by transciever_info.
+var transcieverExtraTags  = []string{"partial_read","suspect","ddm_type","rx_power_type","diag_supported","alias"}
 var transcieverLabels     = []string{"iface"}
+// transcieverInfoLabels are identity tags exported by transciever_info
+var transcieverInfoLabels = []string{"vendor","product","revision","serial","oui","mfgdate","wavelen","encoding","rate_id","bitrate","tx_wavelength_nm","rx_wavelength_nm","ddm_type","alias"}
+
+// transcieverTags returns names of tags of influx, JSON, statsd and CSV output, without iface and error
+func transcieverTags() []string {
+    return append(append([]string{}, transcieverFullLabels[2:]...), transcieverExtraTags...)
+}
 
 var (
-    transciever_present = prometheus.NewDesc(
-        prometheus.BuildFQName(namespace, "", "transciever_present"),
-        "Scrape of transciever was successfull",
-        transcieverFullLabels, nil,
+    interfaces_discovered = prometheus.NewDesc(
+        prometheus.BuildFQName(namespace, "", "interfaces_discovered"),
+        "Number of interfaces matching device globs in last scrape",
+        nil, nil,
+    )
+    interfaces_collected = prometheus.NewDesc(
+        prometheus.BuildFQName(namespace, "", "interfaces_collected"),
+        "Number of interfaces scraped without error in last scrape",
+        nil, nil,
+    )
+    collect_errors = prometheus.NewDesc(
+        prometheus.BuildFQName(namespace, "", "collect_errors_total"),
+        "Number of errors of exporter itself, by reason",
+        []string{"reason"}, nil,
     )
-    transciever_temp = prometheus.NewDesc(
-        prometheus.BuildFQName(namespace, "", "transciever_temp"),
-        "Transciever temperature (C)",
-        transcieverLabels, nil,
+    socket_resets = prometheus.NewDesc(
+        prometheus.BuildFQName(namespace, "", "socket_resets_total"),
+        "Number of times ethtool socket was reopened after EBADF or ENOTCONN",
+        nil, nil,
     )
-    transciever_volt = prometheus.NewDesc(
-        prometheus.BuildFQName(namespace, "", "transciever_volt"),
-        "Transciever voltage (V)",
-        transcieverLabels, nil,
+    exported_series = prometheus.NewDesc(
+        prometheus.BuildFQName(namespace, "", "exported_series"),
+        "Number of per interface series exported in this scrape, to catch label explosions",
+        nil, nil,
     )
-    transciever_bias = prometheus.NewDesc(
-        prometheus.BuildFQName(namespace, "", "transciever_bias"),
-        "Laser bias current (A)",
-        transcieverLabels, nil,
+    cache_entries = prometheus.NewDesc(
+        prometheus.BuildFQName(namespace, "", "cache_entries"),
+        "Number of optics whose static info is cached by serial number",
+        nil, nil,
     )
-    transciever_txw = prometheus.NewDesc(
-        prometheus.BuildFQName(namespace, "", "transciever_txw"),
-        "Laser output power (W)",
-        transcieverLabels, nil,
+    collect_in_flight = prometheus.NewDesc(
+        prometheus.BuildFQName(namespace, "", "collect_in_flight"),
+        "Number of serial groups of interfaces currently reading hardware",
+        nil, nil,
     )
-    transciever_rxw = prometheus.NewDesc(
-        prometheus.BuildFQName(namespace, "", "transciever_rxw"),
-        "Receiver signal average optical power (W)",
-        transcieverLabels, nil,
+    collect_queued = prometheus.NewDesc(
+        prometheus.BuildFQName(namespace, "", "collect_queued"),
+        "Number of serial groups of interfaces waiting for -max-parallel slot",
+        nil, nil,
+    )
+    scrapes_total = prometheus.NewDesc(
+        prometheus.BuildFQName(namespace, "", "scrapes_total"),
+        "Number of scrapes of all interfaces, including background ones",
+        nil, nil,
+    )
+    last_scrape_error = prometheus.NewDesc(
+        prometheus.BuildFQName(namespace, "", "last_scrape_error"),
+        "Error of whole last scrape, empty on success (errors of single interfaces are in transciever_present)",
+        []string{"error"}, nil,
+    )
+    last_scrape_duration = prometheus.NewDesc(
+        prometheus.BuildFQName(namespace, "", "last_scrape_duration_seconds"),
+        "Duration of whole last scrape of all interfaces",
+        nil, nil,
     )
 )
+
+// transcieverDescs are built per exporter, as their labels and names depend on configuration
+type transcieverDescs struct {
+    present    *prometheus.Desc
+    info       *prometheus.Desc
+    errorInfo  *prometheus.Desc // only with -stable-labels
+    eepromError *prometheus.Desc // only with -diag-source auto
+    removed    *prometheus.Desc
+    option     *prometheus.Desc
+    sff8472Rev *prometheus.Desc
+    compliance *prometheus.Desc
+    age        *prometheus.Desc
+    firstSeen  *prometheus.Desc
+    softTxDisable *prometheus.Desc
+    hasDdm     *prometheus.Desc
+    rxPowerType *prometheus.Desc
+    bidi       *prometheus.Desc
+    ddmUnavailable *prometheus.Desc
+    maxPower   *prometheus.Desc
+    eepromChanged *prometheus.Desc
+    sampled    *prometheus.Desc
+    inventoryMatch *prometheus.Desc
+    partialRead *prometheus.Desc
+    suspect    *prometheus.Desc
+    diagSupported *prometheus.Desc
+    temp       *prometheus.Desc
+    tempPeak   *prometheus.Desc
+    tempEma    *prometheus.Desc
+    volt       *prometheus.Desc
+    bias       *prometheus.Desc
+    txw        *prometheus.Desc
+    rxw        *prometheus.Desc
+    txDisable  *prometheus.Desc
+    txFault    *prometheus.Desc
+    rxLos      *prometheus.Desc
+    rxMargin   *prometheus.Desc
+    aux        *prometheus.Desc
+    txMargin   *prometheus.Desc
+    loss       *prometheus.Desc
+    linkSpeed  *prometheus.Desc
+    linkUp     *prometheus.Desc
+    adminUp    *prometheus.Desc
+    linkDuplex *prometheus.Desc
+    tempMax    *prometheus.Desc
+}
+
+// newDesc builds descriptor of per interface metric, label names are renamed by -relabel
+func (e *Exporter) newDesc(name string, help string, ifaceLabels []string, labels ...string) *prometheus.Desc {
+    all := append(append([]string{}, ifaceLabels...), labels...)
+    seen := make(map[string]string)
+    for i, label := range(all) {
+        e.descLabels[label] = true
+        all[i] = e.relabeled(label)
+        if other, found := seen[all[i]]; found && e.descErr == nil {
+            e.descErr = fmt.Errorf("Labels '%s' and '%s' of %s_%s are both named '%s' after -relabel", other, label, namespace, name, all[i])
+        }
+        seen[all[i]] = label
+    }
+    return prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), help, all, nil)
+}
+
+// relabeled returns name of label after -relabel
+func (e *Exporter) relabeled(label string) string {
+    if renamed, found := e.relabel[label]; found {
+        return renamed
+    }
+    return label
+}
+
+// SetRelabel renames labels of per interface metrics, specs are old=new
+func (e *Exporter) SetRelabel(specs []string) error {
+    relabel := make(map[string]string)
+    for _, spec := range(specs) {
+        eq := strings.Index(spec, "=")
+        if eq < 0 {
+            return fmt.Errorf("Invalid -relabel '%s', expected old=new", spec)
+        }
+        if !labelNameRegex.MatchString(spec[eq+1:]) || strings.HasPrefix(spec[eq+1:], "__") {
+            return fmt.Errorf("Invalid label name '%s' in -relabel '%s'", spec[eq+1:], spec)
+        }
+        if _, found := relabel[spec[:eq]]; found {
+            return fmt.Errorf("Label '%s' is relabeled twice", spec[:eq])
+        }
+        relabel[spec[:eq]] = spec[eq+1:]
+    }
+    previous := e.relabel
+    e.relabel = relabel
+    err := e.buildDescs()
+    for _, spec := range(specs) {
+        if err != nil {
+            break
+        }
+        if old := spec[:strings.Index(spec, "=")]; !e.descLabels[old] {
+            err = fmt.Errorf("Unknown label '%s' in -relabel '%s'", old, spec)
+        }
+    }
+    if err != nil {
+        e.relabel = previous
+        e.buildDescs()
+    }
+    return err
+}
+
+// presentLabels returns labels of transciever_present metric
+func (e *Exporter) presentLabels() []string {
+    if e.stableLabels {
+        // error is exported as separate transciever_error_info metric
+        return append(append([]string{}, e.ifaceLabels...), transcieverFullLabels[2:]...)
+    }
+    return append(append([]string{}, e.ifaceLabels...), transcieverFullLabels[1:]...)
+}
+
+// buildDescs creates descs of per interface metrics, it returns label collision caused by -relabel
+func (e *Exporter) buildDescs() error {
+    e.descLabels = make(map[string]bool)
+    e.descErr = nil
+    il := e.ifaceLabels
+    dl := il // labels of monitors that are read from both sides with -dual-side
+    if e.lineSideOffset > 0 {
+        dl = append(append([]string{}, il...), "side")
+    }
+    pu := e.gaugePowerUnit()
+    e.descs = transcieverDescs{
+        present:   e.newDesc("transciever_present", "Scrape of transciever was successfull", nil, e.presentLabels()...),
+        info:      e.newDesc("transciever_info", "Transciever identity, always 1", il, transcieverInfoLabels...),
+        errorInfo: e.newDesc("transciever_error_info", "Error encountered during scrape of transciever", il, "error"),
+        eepromError: e.newDesc("transciever_eeprom_error_info", "EEPROM of transciever could not be read, diagnostics are from hwmon", il, "error"),
+        removed:   e.newDesc("transciever_removed", "Interface disappeared before transciever could be scraped (-report-removed)", il),
+        inventoryMatch: e.newDesc("transciever_inventory_match", "Serial of optic matches -inventory-file, -1 when interface is not in inventory", il),
+        sampled:   e.newDesc("transciever_sampled", "Interface was collected in this scrape, 0 when its last result was repeated (-sample-fraction)", il),
+        partialRead: e.newDesc("transciever_partial_read", "Some module info fields could not be read, they are missing in labels (see partial_read influx tag)", il),
+        suspect:   e.newDesc("transciever_suspect", "Decoded value of field is out of sane bounds (garbage read), it is omitted from labels", il, "field"),
+        diagSupported: e.newDesc("transciever_diag_supported", "Module type is supported, 0 for modules reported with -unsupported-as-present", il),
+        eepromChanged: e.newDesc("transciever_eeprom_changed", "Identity EEPROM area differs from the first one seen for this serial", il),
+        option:    e.newDesc("transciever_option", "Transciever supports given option (SFF-8472 A0h bytes 64-65 and 93)", il, "option"),
+        compliance: e.newDesc("transciever_compliance", "Extended specification compliance code of transciever (A0h byte 36), always 1", il, "spec"),
+        sff8472Rev: e.newDesc("transciever_sff8472_rev", "SFF-8472 revision the transciever claims compliance with (A0h byte 94), always 1", il, "rev"),
+        hasDdm:    e.newDesc("transciever_has_ddm", "Transciever advertises digital diagnostics (A0h byte 92) and they were read", il),
+        ddmUnavailable: e.newDesc("transciever_ddm_unavailable_reason", "Transciever has no digital diagnostics for given reason, always 1", il, "reason"),
+        bidi:      e.newDesc("transciever_bidi", "Transciever is bidirectional (single fiber), guessed from part number", il),
+        rxPowerType: e.newDesc("transciever_rx_power_type", "Receiver power is measured as average or OMA (A0h byte 92 bit 3), always 1", il, "type"),
+        maxPower:  e.newDesc("transciever_max_power_watts", "Maximum power consumption of declared power level of transciever (A0h byte 64)", il),
+        softTxDisable: e.newDesc("transciever_soft_tx_disable_supported", "TX disable can be controlled by A2h byte 110 bit 6, not only by TX_DISABLE pin", il),
+        firstSeen: e.newDesc("transciever_first_seen_timestamp_seconds", "When the transciever was seen in the interface for the first time", il),
+        age:       e.newDesc("transciever_age_seconds", "Time since manufacturing date of transciever", il),
+        temp:      e.newDesc("transciever_temp" + e.tempUnit.suffix, fmt.Sprintf("Transciever temperature (%s)", e.tempUnit.unit), dl),
+        tempPeak:  e.newDesc("transciever_temp_peak_celsius", "Highest transciever temperature seen since the optic was inserted (C)", il),
+        tempEma:   e.newDesc("transciever_temp_ema_celsius", "Exponential moving average of transciever temperature across scrapes (C)", il),
+        volt:      e.newDesc("transciever_volt" + e.voltUnit.suffix, fmt.Sprintf("Transciever voltage (%s)", e.voltUnit.unit), dl),
+        bias:      e.newDesc("transciever_bias", "Laser bias current (A)", il),
+        txw:       e.newDesc("transciever_txw" + pu.suffix, fmt.Sprintf("Laser output power (%s)", pu.unit), dl),
+        rxw:       e.newDesc("transciever_rxw" + pu.suffix, fmt.Sprintf("Receiver signal average optical power (%s)", pu.unit), dl),
+        txDisable: e.newDesc("transciever_tx_disable", "Transmitter is disabled (A2h byte 110 bit 7)", il),
+        txFault:   e.newDesc("transciever_tx_fault", "Transmitter fault (A2h byte 110 bit 2)", il),
+        rxLos:     e.newDesc("transciever_rx_los", "Receiver loss of signal (A2h byte 110 bit 1)", il),
+        aux:       e.newDesc("transciever_aux", "Auxiliary monitor (A2h bytes 106-109) of type given by A0h byte 98 with -aux-monitors, unit is part of type", il, "type"),
+        rxMargin:  e.newDesc("transciever_rx_power_margin_db", "Receiver power above its low warning threshold (dB)", il),
+        txMargin:  e.newDesc("transciever_tx_power_margin_db", "Laser output power above its low warning threshold (dB)", il),
+        loss:      e.newDesc("transciever_estimated_loss_db", "Link loss estimated as -link-tx-reference minus receiver power (dB)", il),
+        linkSpeed: e.newDesc("link_speed_mbps", "Negotiated link speed (Mbps)", il),
+        linkUp:    e.newDesc("link_up", "Operational state of interface is up (sysfs operstate)", il),
+        adminUp:   e.newDesc("admin_up", "Interface is administratively up (IFF_UP in sysfs flags)", il),
+        linkDuplex: e.newDesc("link_duplex", "Link is full duplex", il),
+        tempMax:   e.newDesc("transciever_temp_max_celsius", "Temperature of the hottest transciever in last scrape", nil, "iface"),
+    }
+    return e.descErr
+}
+
+// labelValues returns values of given labels for interface
+func (e *Exporter) labelValues(labels []string, iface string, err error, tags map[string]string) []string {
+    values := make([]string, len(labels))
+    for i, label := range(labels) {
+        switch label {
+            case "error": if err != nil { values[i] = err.Error() }
+            case "iface": values[i] = iface
+            case "cage":  values[i] = e.cage(iface)
+            default:
+                values[i] = tags[label]
+        }
+        values[i] = sanitizeLabel(values[i])
+    }
+    return values
+}
+
+// sanitizeLabel makes label value from garbage EEPROM safe for prometheus, similarly to influx tags:
+// invalid UTF-8 is replaced by "~" and control characters by space
+func sanitizeLabel(value string) string {
+    if !utf8.ValidString(value) {
+        value = strings.ToValidUTF8(value, "~")
+    }
+    return labelControlChars.ReplaceAllString(value, " ")
+}
+
+type unitScale struct {
+    suffix string // appended to metric name, empty for default unit
+    unit   string
+    mult   float64
+    offset float64
+}
+
+func (u unitScale) Convert(value float64) float64 {
+    return value * u.mult + u.offset
+}
+
+var temperatureUnits = map[string]unitScale{
+    "C":  { suffix: "",            unit: "C",  mult: 1,    offset: 0      },
+    "K":  { suffix: "_kelvin",     unit: "K",  mult: 1,    offset: 273.15 },
+}
+var voltageUnits = map[string]unitScale{
+    "V":  { suffix: "",            unit: "V",  mult: 1,    offset: 0      },
+    "mV": { suffix: "_millivolts", unit: "mV", mult: 1000, offset: 0      },
+}
+
+// powerUnit selects unit of prometheus power gauges and of influx power fields exported besides the _W ones
+type powerUnit struct {
+    suffix string  // appended to metric name, empty for default unit (W)
+    unit   string
+    field  string  // influx field name suffix
+    precision int  // default decimal places of influx field
+    ref_mW float64 // reference power of decibel units, 0 for linear mW
+}
+
+var powerUnits = map[string]powerUnit{
+    "dbm":  { suffix: "",            unit: "W",    field: "dBm",  precision: 2, ref_mW: 1     },
+    "dbuw": { suffix: "_dbuw",       unit: "dBuW", field: "dBuW", precision: 2, ref_mW: 0.001 },
+    "mw":   { suffix: "_milliwatts", unit: "mW",   field: "mW",   precision: 4, ref_mW: 0     },
+}
+
+// powerGaugeDbm is unit of prometheus gauges with -power-primary dbm
+var powerGaugeDbm = powerUnit{ suffix: "_dbm", unit: "dBm", field: "dBm", precision: 2, ref_mW: 1 }
+
+// Field converts power to unit of influx field
+func (u powerUnit) Field(mW float64) float64 {
+    if u.ref_mW == 0 {
+        return mW
+    }
+    return sff8472.PowerDecibels(mW, u.ref_mW)
+}
+
+// Gauge converts power to unit of prometheus gauge, dBm is exported as W (prometheus base unit)
+func (u powerUnit) Gauge(mW float64) float64 {
+    if u.suffix == "" {
+        return mW * 0.001
+    }
+    return u.Field(mW)
+}
+
+// influxTimePrecisions are units of influx timestamps, named as precision parameter of InfluxDB write endpoint
+var influxTimePrecisions = map[string]time.Duration{
+    "s":  time.Second,
+    "ms": time.Millisecond,
+    "us": time.Microsecond,
+    "ns": time.Nanosecond,
+}
+
+// influxPrecision is number of decimal places of influx fields
+type influxPrecision struct {
+    temperature int
+    voltage     int
+    bias        int
+    power       int // fields in -power-unit, negative means default of the unit
+    power_W     int
+}
+
+var defaultInfluxPrecision = influxPrecision{ temperature: 2, voltage: 3, bias: 6, power: -1, power_W: 7 }
+
+// parseInfluxPrecision overrides defaults by comma separated field=digits, i.e. "power=3,power_W=9"
+func parseInfluxPrecision(spec string) (influxPrecision, error) {
+    ret := defaultInfluxPrecision
+    if spec == "" {
+        return ret, nil
+    }
+    fields := map[string]*int{
+        "temperature": &ret.temperature,
+        "voltage":     &ret.voltage,
+        "bias":        &ret.bias,
+        "power":       &ret.power,
+        "power_W":     &ret.power_W,
+    }
+    for _, item := range(strings.Split(spec, ",")) {
+        eq := strings.Index(item, "=")
+        if eq < 0 {
+            return ret, fmt.Errorf("Invalid influx precision '%s', expected field=digits", item)
+        }
+        field, found := fields[strings.TrimSpace(item[:eq])]
+        if !found {
+            return ret, fmt.Errorf("Unknown influx field '%s'", item[:eq])
+        }
+        digits, err := strconv.Atoi(strings.TrimSpace(item[eq+1:]))
+        if err != nil || digits < 0 || digits > 15 {
+            return ret, fmt.Errorf("Invalid influx precision '%s'", item)
+        }
+        *field = digits
+    }
+    return ret, nil
+}
 // }}}
 
 type Exporter struct { // {{{
+    metricBuildErrors uint64 // accessed atomically, first to be 64-bit aligned on 32-bit platforms
+    scrapes      uint64 // accessed atomically
     pathGlob     []string
+    ifaceNames   []string // literal interface names, added to glob results
     debug        bool
     txrInfoFlags int
-    parallel     *regexp.Regexp
+    parallel     []*regexp.Regexp
+    diagSource   int
+    collectLink  bool
+    readInterval time.Duration
+    stableLabels bool
+    tempUnit     unitScale
+    voltUnit     unitScale
+    powerUnit    powerUnit
+    powerPrimaryDbm bool // prometheus power gauges in dBm instead of watts
+    influxPrecision influxPrecision
+    influxPerMetric bool
+    influxTimePrecision string // key of influxTimePrecisions
+    cageRegex    *regexp.Regexp
+    relabel      map[string]string // -relabel, applied by newDesc
+    descLabels   map[string]bool // labels of descs before -relabel, collected by newDesc
+    descErr      error // first label collision after -relabel, found by newDesc
+    ifaceLabels  []string
+    descs        transcieverDescs
+    tempHistory  *TempHistory
+    firstSeen    *FirstSeen
+    emptyCages   *EmptyCages // nil without -empty-cage-cache
+    eepromHashes *EepromHashes // non-nil with -check-eeprom
+    exposeEepromHash bool // eeprom_hash label of transciever_info
+    snapshot     *Snapshot // non-nil when scraping in background
+    sampling     *sampleRotation // non-nil with -sample-fraction below 1
+    inventory    *Inventory // non-nil with -inventory-file
+    maxAge       time.Duration
+    pusher       *InfluxPusher // pushes every background scrape, optional
+    statsd       *StatsDChan   // receives every background scrape, optional
+    lineSideOffset uint32 // of secondary diagnostics, 0 when disabled
+    powerHistograms *PowerHistograms // non-nil with -power-histograms
+    unsupportedAsPresent bool
+    netns bool // interfaces are in other network namespace (-netns), their sysfs is not visible
+    reportRemoved bool // emit interface that vanished during scrape with ErrInterfaceRemoved instead of skipping it
+    linkTxReference *float64 // dBm of far end transmitter, nil when not set
+    scrapeTimeout time.Duration // of single interface, 0 for no limit
+    collectDeadline time.Duration // of whole DiscoverAndCollect, 0 for no limit
+    limiter      collectLimiter
+    validated    map[string]bool // interfaces whose EEPROM tables were validated
+    validatedMutex sync.Mutex
+    lastScrapeError    string
+    lastScrapeDuration time.Duration
+    lastScrapeMutex    sync.Mutex
+    staleReaders map[string]chan struct{} // serial key -> closed when abandoned collection returns, see waitStale
+    staleMutex   sync.Mutex
+}
+
+// collectLimiter limits number of serial groups reading hardware at once
+type collectLimiter struct {
+    slots    chan struct{} // nil when unlimited
+    inFlight int32
+    queued   int32
 }
 
-func NewExporter(pathGlob []string, debug bool, parallel *regexp.Regexp) (*Exporter, error) {
-    flagList := make([]string, len(transcieverFullLabels)-1)
-    copy(flagList[1:], transcieverFullLabels[2:])
+// Acquire waits for free slot, it returns false when ctx was cancelled meanwhile
+func (l *collectLimiter) Acquire(ctx context.Context) bool {
+    if l.slots != nil {
+        atomic.AddInt32(&l.queued, 1)
+        select {
+            case l.slots <- struct{}{}:
+                atomic.AddInt32(&l.queued, -1)
+            case <-ctx.Done():
+                atomic.AddInt32(&l.queued, -1)
+                return false
+        }
+    }
+    atomic.AddInt32(&l.inFlight, 1)
+    return true
+}
+
+func (l *collectLimiter) Release() {
+    atomic.AddInt32(&l.inFlight, -1)
+    if l.slots != nil {
+        <-l.slots
+    }
+}
+
+func NewExporter(pathGlob []string, debug bool, parallel []*regexp.Regexp) (*Exporter, error) {
+    tags := transcieverTags()
+    flagList := make([]string, len(tags)+1)
+    copy(flagList[1:], tags)
     // CACHE would be sufficient, the other entries are just for validating that we get them back
     flagList[0] = "CACHE"
-    flags, err := GetTxrInfoFlags(flagList)
+    flags, err := sff8472.GetTxrInfoFlags(flagList)
     if err != nil { return nil, err }
-    return &Exporter{
+    e := &Exporter{
         pathGlob:     pathGlob,
         txrInfoFlags: flags,
         debug:        debug,
         parallel:     parallel,
-    }, nil
+        tempUnit:     temperatureUnits["C"],
+        voltUnit:     voltageUnits["V"],
+        powerUnit:    powerUnits["dbm"],
+        influxPrecision: defaultInfluxPrecision,
+        influxTimePrecision: "ns",
+        ifaceLabels:  transcieverLabels,
+        tempHistory:  NewTempHistory(),
+        firstSeen:    NewFirstSeen(),
+        validated:    make(map[string]bool),
+        staleReaders: make(map[string]chan struct{}),
+    }
+    e.buildDescs()
+    return e, nil
+}
+
+// FlushCaches makes next scrape read static info of all optics again, i.e. after optics were swapped.
+// Statistics (temperature history, first seen) are kept, see ResetStatistics.
+func (e *Exporter) FlushCaches() {
+    sff8472.FlushModuleCache()
+    if e.eepromHashes != nil {
+        e.eepromHashes.Flush()
+    }
+    if e.emptyCages != nil {
+        e.emptyCages.Flush()
+    }
+}
+
+// ResetStatistics forgets per optic statistics kept across scrapes (temperature history, first seen)
+func (e *Exporter) ResetStatistics() {
+    e.tempHistory.Flush()
+    e.firstSeen.Flush()
+}
+
+// FlushOnSighup calls FlushCaches and ResetStatistics whenever SIGHUP is received
+func (e *Exporter) FlushOnSighup() {
+    hup := make(chan os.Signal, 1)
+    signal.Notify(hup, syscall.SIGHUP)
+    go func() {
+        for range(hup) {
+            e.FlushCaches()
+            e.ResetStatistics()
+            fmt.Fprintf(os.Stderr, "SIGHUP: module info cache flushed, statistics reset\n")
+            if e.inventory != nil {
+                if err := e.inventory.Reload(); err != nil {
+                    fmt.Fprintf(os.Stderr, "SIGHUP: inventory not reloaded: %v\n", err)
+                } else {
+                    fmt.Fprintf(os.Stderr, "SIGHUP: inventory reloaded\n")
+                }
+            }
+        }
+    }()
+}
+
+// SetDualSide enables reading of line side monitors at given EEPROM offset, 0 disables it
+func (e *Exporter) SetDualSide(offset uint32) {
+    e.lineSideOffset = offset
+    e.buildDescs()
+}
+
+// SetMaxParallel limits number of serial groups collected at once, 0 means unlimited
+func (e *Exporter) SetMaxParallel(max int) {
+    e.limiter.slots = nil
+    if max > 0 {
+        e.limiter.slots = make(chan struct{}, max)
+    }
+}
+
+// SetNetns scrapes interfaces of other network namespace. Only ethtool ioctl and netlink sockets enter it,
+// so features reading sysfs of interfaces are unavailable: hwmon diagnostics are rejected, alias, link
+// state and following of renamed interfaces are skipped. It has to be called after diagSource is set.
+func (e *Exporter) SetNetns(netns string) error {
+    if netns != "" && e.diagSource != DIAG_SOURCE_ETHTOOL {
+        return errors.New("hwmon diagnostics are read from sysfs of exporter's namespace, -diag-source has to be ethtool with -netns")
+    }
+    e.netns = netns != ""
+    sff8472.EthToolNetns = netns
+    return nil
+}
+
+func (e *Exporter) SetStableLabels(stable bool) {
+    e.stableLabels = stable
+    e.buildDescs()
+}
+
+// SetCageRegex adds "cage" label with concatenated capture groups of regex matched against interface name
+func (e *Exporter) SetCageRegex(cageRegex *regexp.Regexp) {
+    e.cageRegex = cageRegex
+    if cageRegex == nil {
+        e.ifaceLabels = transcieverLabels
+    } else {
+        e.ifaceLabels = append(append([]string{}, transcieverLabels...), "cage")
+    }
+    e.buildDescs()
+}
+
+func (e *Exporter) cage(iface string) string {
+    if e.cageRegex == nil { return "" }
+    groups := e.cageRegex.FindStringSubmatch(iface)
+    if groups == nil { return iface }
+    if len(groups) == 1 { return groups[0] }
+    return strings.Join(groups[1:], "")
+}
+
+// SetUnits selects units of temperature and voltage gauges, i.e. "K,mV"
+func (e *Exporter) SetUnits(units string) error {
+    for _, unit := range(strings.Split(units, ",")) {
+        unit = strings.TrimSpace(unit)
+        if u, found := temperatureUnits[unit]; found {
+            e.tempUnit = u
+        } else if u, found := voltageUnits[unit]; found {
+            e.voltUnit = u
+        } else {
+            return fmt.Errorf("Unknown unit '%s'", unit)
+        }
+    }
+    e.buildDescs()
+    return nil
+}
+
+// SetPowerPrimary selects whether prometheus power gauges are in watts (default, or unit of -power-unit) or in dBm
+func (e *Exporter) SetPowerPrimary(primary string) error {
+    switch strings.ToLower(primary) {
+        case "watts": e.powerPrimaryDbm = false
+        case "dbm":   e.powerPrimaryDbm = true
+        default: return fmt.Errorf("Unknown primary power unit '%s'", primary)
+    }
+    e.buildDescs()
+    return nil
+}
+
+// gaugePowerUnit returns unit of prometheus power gauges
+func (e *Exporter) gaugePowerUnit() powerUnit {
+    if e.powerPrimaryDbm {
+        return powerGaugeDbm
+    }
+    return e.powerUnit
+}
+
+// SetPowerUnit selects unit of optical power: dbm (default), dbuw or mw
+func (e *Exporter) SetPowerUnit(unit string) error {
+    u, found := powerUnits[strings.ToLower(unit)]
+    if !found {
+        return fmt.Errorf("Unknown power unit '%s'", unit)
+    }
+    e.powerUnit = u
+    e.buildDescs()
+    return nil
 }
 
 func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
-    ch <- transciever_present
-    ch <- transciever_temp
-    ch <- transciever_volt
-    ch <- transciever_bias
-    ch <- transciever_txw
-    ch <- transciever_rxw
+    ch <- interfaces_discovered
+    ch <- interfaces_collected
+    ch <- e.descs.tempMax
+    if e.powerHistograms != nil {
+        e.powerHistograms.Describe(ch)
+    }
+    ch <- collect_errors
+    ch <- socket_resets
+    ch <- cache_entries
+    ch <- exported_series
+    ch <- collect_in_flight
+    ch <- collect_queued
+    ch <- scrapes_total
+    ch <- last_scrape_error
+    ch <- last_scrape_duration
+    d := &e.descs
+    ch <- d.present
+    ch <- d.info
+    if e.stableLabels {
+        ch <- d.errorInfo
+    }
+    if e.diagSource == DIAG_SOURCE_AUTO {
+        ch <- d.eepromError
+    }
+    ch <- d.removed
+    ch <- d.option
+    ch <- d.sff8472Rev
+    ch <- d.compliance
+    ch <- d.age
+    ch <- d.firstSeen
+    ch <- d.softTxDisable
+    ch <- d.hasDdm
+    ch <- d.rxPowerType
+    ch <- d.bidi
+    ch <- d.ddmUnavailable
+    ch <- d.maxPower
+    if e.eepromHashes != nil {
+        ch <- d.eepromChanged
+    }
+    if e.sampling != nil {
+        ch <- d.sampled
+    }
+    if e.inventory != nil {
+        ch <- d.inventoryMatch
+    }
+    ch <- d.partialRead
+    ch <- d.suspect
+    if e.unsupportedAsPresent {
+        ch <- d.diagSupported
+    }
+    ch <- d.temp
+    ch <- d.tempPeak
+    ch <- d.tempEma
+    ch <- d.volt
+    ch <- d.bias
+    ch <- d.txw
+    ch <- d.rxw
+    ch <- d.txDisable
+    ch <- d.txFault
+    ch <- d.rxLos
+    ch <- d.aux
+    ch <- d.rxMargin
+    ch <- d.txMargin
+    if e.linkTxReference != nil {
+        ch <- d.loss
+    }
+    if e.collectLink {
+        ch <- d.linkSpeed
+        ch <- d.linkUp
+        ch <- d.adminUp
+        ch <- d.linkDuplex
+    }
+}
+
+// splitGlobs splits comma separated globs. Path list separator (colon) cannot be used,
+// as it is part of PCI device names in sysfs paths.
+func splitGlobs(globs []string) []string {
+    var ret []string
+    for _, list := range(globs) {
+        ret = append(ret, strings.FieldsFunc(list, func(r rune) bool { return r == ',' })...)
+    }
+    return ret
 }
 
 func (e *Exporter) GetIfaces() ([]string, error) {
     var ret []string
-    for _, glob := range(e.pathGlob) {
+    for _, glob := range(splitGlobs(e.pathGlob)) {
+        if len(glob) > 1 {
+            // "/sys/class/net/eth*/" names the interface directory itself
+            glob = strings.TrimRight(glob, "/")
+        }
         matches, err := filepath.Glob(glob)
         if e.debug {
             fmt.Printf("GetIfaces() %v -> %v\n", glob, matches)
         }
         if err != nil { return nil, err }
         for _, match := range(matches) {
+            match = strings.TrimRight(match, "/")
             slash := strings.LastIndex(match, "/")
             ret = append(ret, match[slash+1:]) // works also for no "/" as slash == -1
         }
     }
+    ret = append(ret, e.ifaceNames...)
     sort.Strings(ret)
     unique.Strings(&ret)
+    SortIfaces(ret)
     return ret, nil
 }
 
+// naturalLess compares interface names with digit runs compared as numbers, so that enp1s0f2 < enp1s0f10.
+// Names that differ only in leading zeros are ordered lexically.
+func naturalLess(a, b string) bool {
+    i, j := 0, 0
+    for i < len(a) && j < len(b) {
+        if isDigit(a[i]) && isDigit(b[j]) {
+            si, sj := i, j
+            for i < len(a) && isDigit(a[i]) { i++ }
+            for j < len(b) && isDigit(b[j]) { j++ }
+            na := strings.TrimLeft(a[si:i], "0")
+            nb := strings.TrimLeft(b[sj:j], "0")
+            if len(na) != len(nb) {
+                return len(na) < len(nb)
+            }
+            if na != nb {
+                return na < nb
+            }
+            continue
+        }
+        if a[i] != b[j] {
+            return a[i] < b[j]
+        }
+        i++
+        j++
+    }
+    if len(a) - i != len(b) - j {
+        return len(a) - i < len(b) - j
+    }
+    return a < b
+}
+
+func isDigit(c byte) bool {
+    return c >= '0' && c <= '9'
+}
+
+// SortIfaces sorts interface names naturally, see naturalLess
+func SortIfaces(ifaces []string) {
+    sort.Slice(ifaces, func(i, j int) bool { return naturalLess(ifaces[i], ifaces[j]) })
+}
+
+// ReadIfalias returns interface alias set by "ip link set dev X alias ...", empty if there is none
+func ReadIfalias(iface string) string {
+    data, err := ioutil.ReadFile(filepath.Join(sysClassNet, iface, "ifalias"))
+    if err != nil { return "" }
+    return strings.TrimSpace(string(data))
+}
+
+// ReadIfindexes returns kernel interface indexes, that survive renaming, of ifaces that still exist
+func ReadIfindexes(ifaces []string) map[string]int {
+    ret := make(map[string]int)
+    for _, iface := range(ifaces) {
+        data, err := ioutil.ReadFile(filepath.Join(sysClassNet, iface, "ifindex"))
+        if err != nil { continue }
+        if index, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+            ret[iface] = index
+        }
+    }
+    return ret
+}
+
+func (e *Exporter) ListIfaces(writer io.Writer, ifaces []string) {
+    for _, iface := range(ifaces) {
+        m, err := sff8472.NewEthToolModule(iface)
+        if err != nil {
+            fmt.Fprintf(writer, "%s\tno module: %v\n", iface, err)
+        } else {
+            fmt.Fprintf(writer, "%s\tmodule type %d, eeprom %d bytes\n", iface, m.Type(), m.EepromLen())
+        }
+    }
+}
+
+// DumpEeprom prints hex dump of whole module EEPROM of the interface
+func DumpEeprom(writer io.Writer, iface string) error {
+    m, err := sff8472.NewEthToolModule(iface)
+    if err != nil { return err }
+    data, err := m.ReadAll()
+    if err != nil { return err }
+    fmt.Fprintf(writer, "%s: module type %d, eeprom %d bytes\n", iface, m.Type(), m.EepromLen())
+    dumper := hex.Dumper(writer)
+    dumper.Write(data)
+    return dumper.Close()
+}
+
 type Emiter interface {
-    Emit(iface string, err error, tags map[string]string, metrics *TranscieverDiagnostics)
+    Emit(iface string, err error, tags map[string]string, metrics *sff8472.TranscieverDiagnostics, link *LinkInfo)
+}
+type MetricChan struct {
+    ch       chan<- prometheus.Metric
+    exporter *Exporter
+    time     time.Time // collection time of replayed snapshot, zero for live scrape
+    series   *uint64   // number of per interface series emitted, optional
+}
+
+// At is used by Snapshot.Replay, metrics then carry explicit timestamp of their collection
+func (mc MetricChan) At(t time.Time) Emiter {
+    mc.time = t
+    return mc
+}
+
+func (mc MetricChan) collectedAt() time.Time {
+    if mc.time.IsZero() {
+        return time.Now()
+    }
+    return mc.time
+}
+
+// gauge sends gauge, series that cannot be built (i.e. wrong number of labels) is skipped and counted
+func (mc MetricChan) gauge(desc *prometheus.Desc, value float64, labels ...string) {
+    metric, err := prometheus.NewConstMetric(desc, prometheus.GaugeValue, value, labels...)
+    if err != nil {
+        atomic.AddUint64(&mc.exporter.metricBuildErrors, 1)
+        if mc.exporter.debug {
+            fmt.Printf("Cannot build metric %v: %v\n", desc, err)
+        }
+        return
+    }
+    if !mc.time.IsZero() {
+        metric = prometheus.NewMetricWithTimestamp(mc.time, metric)
+    }
+    if mc.series != nil {
+        atomic.AddUint64(mc.series, 1)
+    }
+    mc.ch <- metric
+}
+
+// InfluxChan sends lines until done is closed (i.e. client disconnected)
+type InfluxChan struct {
+    ch        chan<- string
+    done      <-chan struct{}
+    power     powerUnit
+    precision influxPrecision
+    perMetric bool // separate measurement for every field, see -influx-measurement-style
 }
-type MetricChan chan<- prometheus.Metric
-type InfluxChan chan<- string
 
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
-    e.DiscoverAndCollect(MetricChan(ch))
+    var series uint64 // every desc and label set is emitted once, so this counts distinct series
+    // error of discovery is exported in last_scrape_error
+    stats, _ := e.CollectTo(context.Background(), MetricChan{ ch: ch, exporter: e, series: &series })
+    ch <- prometheus.MustNewConstMetric(exported_series, prometheus.GaugeValue, float64(atomic.LoadUint64(&series)))
+    ch <- prometheus.MustNewConstMetric(interfaces_discovered, prometheus.GaugeValue, float64(stats.discovered))
+    ch <- prometheus.MustNewConstMetric(interfaces_collected,  prometheus.GaugeValue, float64(stats.collected))
+    if e.powerHistograms != nil {
+        e.powerHistograms.Collect(ch)
+    }
+    if stats.hottest != "" {
+        ch <- prometheus.MustNewConstMetric(e.descs.tempMax, prometheus.GaugeValue, stats.maxTemp_C, stats.hottest)
+    }
+    ch <- prometheus.MustNewConstMetric(collect_errors, prometheus.CounterValue, float64(atomic.LoadUint64(&e.metricBuildErrors)), "metric_build")
+    ch <- prometheus.MustNewConstMetric(socket_resets, prometheus.CounterValue, float64(atomic.LoadUint64(&sff8472.EthToolSocketResets)))
+    ch <- prometheus.MustNewConstMetric(cache_entries, prometheus.GaugeValue, float64(sff8472.ModuleCacheEntries()))
+    ch <- prometheus.MustNewConstMetric(collect_in_flight, prometheus.GaugeValue, float64(atomic.LoadInt32(&e.limiter.inFlight)))
+    ch <- prometheus.MustNewConstMetric(collect_queued,    prometheus.GaugeValue, float64(atomic.LoadInt32(&e.limiter.queued)))
+    ch <- prometheus.MustNewConstMetric(scrapes_total, prometheus.CounterValue, float64(atomic.LoadUint64(&e.scrapes)))
+    e.lastScrapeMutex.Lock()
+    defer e.lastScrapeMutex.Unlock()
+    ch <- prometheus.MustNewConstMetric(last_scrape_error, prometheus.GaugeValue, 1, e.lastScrapeError)
+    ch <- prometheus.MustNewConstMetric(last_scrape_duration, prometheus.GaugeValue, e.lastScrapeDuration.Seconds())
+}
+
+// ScrapeStats summarizes one DiscoverAndCollect run
+type ScrapeStats struct {
+    discovered int // interfaces matching globs
+    collected  int // interfaces scraped without error
+    hottest    string // interface with highest transciever temperature, empty when there is none
+    maxTemp_C  float64
+}
+
+// CollectTo emits last snapshot of background scraping or, without it, scrapes transcievers now
+func (e *Exporter) CollectTo(ctx context.Context, ch Emiter) (ScrapeStats, error) {
+    if e.snapshot != nil {
+        return e.snapshot.Replay(ch, e.maxAge), nil
+    }
+    return e.DiscoverAndCollect(ctx, ch)
 }
 
-func (e *Exporter) DiscoverAndCollect(ch Emiter) {
+// WarmUpCache reads static info of every discovered interface into module cache,
+// so that the first scrape does not have to
+func (e *Exporter) WarmUpCache() {
+    if e.txrInfoFlags & sff8472.TXR_MI_CACHE == 0 || sff8472.ModuleCacheDisabled {
+        return
+    }
     ifaces, err := e.GetIfaces()
-    if (err != nil) {
-        panic(err)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Error: warm-up: %v\n", err)
+        return
     }
-    parallel := make(map[string][]string)
+    throttle := sff8472.NewReadThrottle(e.readInterval)
     for _, iface := range(ifaces) {
-        groups := e.parallel.FindStringSubmatch(iface)
-        var key string
-        if groups == nil {
-            key = "\x01!nil!"
-        } else {
-            key = strings.Join(groups[1:], "\x02")
+        m, err := sff8472.NewEthToolModule(iface)
+        if err != nil {
+            continue
         }
-        values, found := parallel[key]
-        if (found) {
-            values = append(values, iface)
-        } else {
-            values = []string{iface}
+        m.Throttle = throttle
+        m.ModuleInfo(e.txrInfoFlags)
+    }
+    if e.debug {
+        fmt.Printf("Cache warm-up finished, %d entries\n", sff8472.ModuleCacheEntries())
+    }
+}
+
+// ScrapeInBackground starts periodic scraping into snapshot, which is then served by CollectTo.
+// Interfaces not collected for longer than maxAge are omitted.
+func (e *Exporter) ScrapeInBackground(interval time.Duration, maxAge time.Duration) {
+    snapshot := NewSnapshot()
+    scrape := func() {
+        stats, err := e.DiscoverAndCollect(context.Background(), snapshot)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Error: scrape: %v\n", err)
         }
-        parallel[key] = values
+        snapshot.SetStats(stats)
     }
+    scrape()
+    e.maxAge = maxAge
+    e.snapshot = snapshot
+    ticker := time.NewTicker(interval)
+    go func() {
+        for {
+            if e.pusher != nil {
+                e.pusher.Push(e)
+            }
+            if e.statsd != nil {
+                stats, _ := e.CollectTo(context.Background(), e.statsd)
+                e.statsd.EmitStats(stats)
+                e.statsd.Flush()
+            }
+            <-ticker.C
+            scrape()
+            snapshot.Expire(maxAge)
+        }
+    }()
+}
+
+// DiscoverAndCollect scrapes all interfaces, remaining interfaces are skipped when ctx is cancelled
+// and reported with ErrDeadlineExceeded after -collect-deadline. Error of interface discovery is returned
+// and recorded in last_scrape_error.
+func (e *Exporter) DiscoverAndCollect(ctx context.Context, ch Emiter) (ScrapeStats, error) {
+    start := time.Now()
+    if e.collectDeadline > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, e.collectDeadline)
+        defer cancel()
+    }
+    ifaces, err := e.GetIfaces()
+    if (err != nil) {
+        e.recordScrape(ctx, ScrapeStats{}, err, time.Since(start))
+        return ScrapeStats{}, err
+    }
+    var ifindexes map[string]int // renamed interfaces are not followed in other network namespace
+    if !e.netns {
+        ifindexes = ReadIfindexes(ifaces)
+    }
+    counter := &countingEmiter{ ch: ch }
+    discovered := len(ifaces)
+    var out Emiter = counter
+    if e.sampling != nil {
+        var replayed []string
+        ifaces, replayed = e.sampling.split(ifaces)
+        e.sampling.replay(counter, replayed)
+        out = sampleEmiter{ ch: counter, cache: e.sampling.cache }
+    }
+    diagCache := NewScrapeDiagCache()
+    parallel := e.serialGroups(ifaces)
     if (len(parallel) < 2) {
-        e.CollectIfacesSerially(ifaces, ch)
+        if e.limiter.Acquire(ctx) {
+            e.CollectIfacesSerially(ctx, ifaces, ifindexes, diagCache, out)
+            e.limiter.Release()
+        } else {
+            e.skipRemaining(ctx, ifaces, out)
+        }
     } else {
         var waitGroup sync.WaitGroup
         for _, series := range(parallel) {
@@ -154,57 +1041,577 @@ func (e *Exporter) DiscoverAndCollect(ch Emiter) {
             waitGroup.Add(1)
             go func (s... string) {
                 defer waitGroup.Done()
-                e.CollectIfacesSerially(s, ch)
+                if !e.limiter.Acquire(ctx) {
+                    e.skipRemaining(ctx, s, out)
+                    return
+                }
+                defer e.limiter.Release()
+                e.CollectIfacesSerially(ctx, s, ifindexes, diagCache, out)
             } (series...)
         }
         waitGroup.Wait()
     }
+    counter.mutex.Lock()
+    defer counter.mutex.Unlock()
+    counter.stats.discovered = discovered
+    e.recordScrape(ctx, counter.stats, nil, time.Since(start))
+    return counter.stats, nil
 }
 
-func (e *Exporter) CollectIfacesSerially(ifaces []string, ch Emiter) {
+// recordScrape remembers result of whole scrape for ethtool_last_scrape_* metrics
+func (e *Exporter) recordScrape(ctx context.Context, stats ScrapeStats, err error, duration time.Duration) {
+    atomic.AddUint64(&e.scrapes, 1)
+    scrapeError := ""
+    if err != nil {
+        scrapeError = err.Error()
+    } else if ctx.Err() != nil {
+        scrapeError = ctx.Err().Error()
+    } else if stats.discovered > 0 && stats.collected == 0 {
+        scrapeError = "no interface collected"
+    }
+    e.lastScrapeMutex.Lock()
+    defer e.lastScrapeMutex.Unlock()
+    e.lastScrapeError = scrapeError
+    e.lastScrapeDuration = duration
+}
+
+// serialGroups splits interfaces into groups collected in parallel (see -parallel), interfaces of one group
+// are collected in series. Groups are in order of their first interface, so that they are started deterministically.
+func (e *Exporter) serialGroups(ifaces []string) [][]string {
+    index := make(map[string]int)
+    var ret [][]string
     for _, iface := range(ifaces) {
-        m, err  := NewEthToolModule(iface)
-        var metrics *TranscieverDiagnostics
-        var tags    map[string]string
-        if err == nil {
-            tags, err = m.ModuleInfo(e.txrInfoFlags)
+        key := e.serialKey(iface)
+        i, found := index[key]
+        if (found) {
+            ret[i] = append(ret[i], iface)
         } else {
-            tags = make(map[string]string)
+            index[key] = len(ret)
+            ret = append(ret, []string{iface})
         }
-        if err == nil {
-            metrics, err = m.TxrDiag()
+    }
+    return ret
+}
+
+// serialKey combines capture groups of all -parallel patterns in their order, interfaces with equal keys
+// are collected in series. Interface not matching a pattern has its own value for that pattern.
+func (e *Exporter) serialKey(iface string) string {
+    keys := make([]string, len(e.parallel))
+    for i, pattern := range(e.parallel) {
+        groups := pattern.FindStringSubmatch(iface)
+        if groups == nil {
+            keys[i] = "\x01!nil!"
+        } else {
+            keys[i] = strings.Join(groups[1:], "\x02")
         }
-        ch.Emit(iface, err, tags, metrics)
     }
+    return strings.Join(keys, "\x03")
 }
 
+// countingEmiter counts interfaces collected without error
+type countingEmiter struct {
+    ch    Emiter
+    mutex sync.Mutex
+    stats ScrapeStats
+}
 
+func (c *countingEmiter) Emit(iface string, err error, tags map[string]string, metrics *sff8472.TranscieverDiagnostics, link *LinkInfo) {
+    c.mutex.Lock()
+    if err == nil {
+        c.stats.collected++
+    }
+    if err == nil && metrics != nil && (c.stats.hottest == "" || metrics.TemperatureC > c.stats.maxTemp_C) {
+        c.stats.hottest = iface
+        c.stats.maxTemp_C = metrics.TemperatureC
+    }
+    c.mutex.Unlock()
+    c.ch.Emit(iface, err, tags, metrics, link)
+}
 
-func (ch MetricChan)Emit(iface string, err error, tags map[string]string, metrics *TranscieverDiagnostics) {
-    labels := make([]string, len(transcieverFullLabels))
-    for i, label := range(transcieverFullLabels) {
-        switch label {
-            case "error": if err != nil { labels[i] = err.Error() }
-            case "iface": labels[i] = iface
-            default:
-                labels[i] = tags[label]
+// renamedIface is called when interface disappeared since discovery, i.e. it was renamed by udev during boot.
+// It returns current name of the device with the same ifindex, or "" when it is gone.
+func (e *Exporter) renamedIface(iface string, ifindex int) string {
+    if ifindex == 0 { return "" }
+    ifaces, err := e.GetIfaces()
+    if err != nil { return "" }
+    for candidate, index := range(ReadIfindexes(ifaces)) {
+        if index == ifindex {
+            return candidate
+        }
+    }
+    return ""
+}
+
+// validate warns once per interface about enabled fields that do not fit in module EEPROM
+func (e *Exporter) validate(iface string, m *sff8472.EthToolModule) {
+    e.validatedMutex.Lock()
+    defer e.validatedMutex.Unlock()
+    if e.validated[iface] {
+        return
+    }
+    e.validated[iface] = true
+    for _, warning := range(m.ValidateTable(e.txrInfoFlags)) {
+        fmt.Fprintf(os.Stderr, "Warning: %s: %s\n", iface, warning)
+    }
+}
+
+// CollectIfacesSerially reads ifaces one by one, ifindexes from discovery are used to follow renamed interfaces.
+// Diagnostics of optics already read in this scrape are taken from diagCache, which may be nil.
+func (e *Exporter) CollectIfacesSerially(ctx context.Context, ifaces []string, ifindexes map[string]int, diagCache *ScrapeDiagCache, ch Emiter) {
+    throttle := sff8472.NewReadThrottle(e.readInterval)
+    var key string
+    if len(ifaces) > 0 {
+        key = e.serialKey(ifaces[0])
+    }
+    for i, iface := range(ifaces) {
+        var record *ifaceRecord
+        if ctx.Err() != nil {
+            // record stays nil
+        } else if !e.waitStale(ctx, key) {
+            if ctx.Err() == nil {
+                // next read would access bus of the stuck interface in parallel
+                for _, skipped := range(ifaces[i:]) {
+                    ch.Emit(skipped, ErrGroupBusy, make(map[string]string), nil, nil)
+                }
+                return
+            }
+        } else if e.scrapeTimeout > 0 || e.collectDeadline > 0 {
+            record = e.collectIfaceWithTimeout(ctx, key, iface, ifindexes, throttle, diagCache)
+        } else {
+            record = e.collectIface(ctx, iface, ifindexes, throttle, diagCache)
+        }
+        if record == nil && ctx.Err() != nil {
+            e.skipRemaining(ctx, ifaces[i:], ch)
+            return
+        }
+        if record != nil {
+            ch.Emit(record.iface, record.err, record.tags, record.metrics, record.link)
+        }
+    }
+}
+
+// skipRemaining reports interfaces left uncollected when -collect-deadline passed,
+// they are silently skipped when ctx was cancelled for other reason (i.e. client is gone)
+func (e *Exporter) skipRemaining(ctx context.Context, ifaces []string, ch Emiter) {
+    if ctx.Err() != context.DeadlineExceeded {
+        return
+    }
+    for _, iface := range(ifaces) {
+        ch.Emit(iface, ErrDeadlineExceeded, make(map[string]string), nil, nil)
+    }
+}
+
+// ErrDeadlineExceeded is reported for interfaces that were not collected within -collect-deadline
+var ErrDeadlineExceeded = errors.New("deadline exceeded")
+
+// collectIfaceWithTimeout abandons collection of interface that takes longer than -scrape-timeout,
+// so that one stuck device does not block the rest of its serial group. It returns nil when ctx is done
+// before collection finished. Abandoned collection stops before its next read, until then it is
+// remembered as stale reader of serial group with key, see waitStale.
+func (e *Exporter) collectIfaceWithTimeout(ctx context.Context, key string, iface string, ifindexes map[string]int, throttle *sff8472.ReadThrottle, diagCache *ScrapeDiagCache) *ifaceRecord {
+    ictx, cancel := context.WithCancel(ctx)
+    defer cancel()
+    done := make(chan *ifaceRecord, 1) // abandoned collection finishes into the buffer, nobody reads it
+    finished := make(chan struct{})
+    go func() {
+        defer close(finished)
+        done <- e.collectIface(ictx, iface, ifindexes, throttle, diagCache)
+    }()
+    var timeout <-chan time.Time
+    if e.scrapeTimeout > 0 {
+        timer := time.NewTimer(e.scrapeTimeout)
+        defer timer.Stop()
+        timeout = timer.C
+    }
+    select {
+        case record := <-done:
+            return record
+        case <-ctx.Done():
+        case <-timeout:
+    }
+    e.staleMutex.Lock()
+    e.staleReaders[key] = finished
+    e.staleMutex.Unlock()
+    if ctx.Err() != nil {
+        return nil
+    }
+    return &ifaceRecord{
+        iface: iface,
+        err:   fmt.Errorf("Timeout: collection took more than %v", e.scrapeTimeout),
+        tags:  make(map[string]string),
+    }
+}
+
+// waitStale waits until collection abandoned in serial group with key (of this or previous scrape) finishes
+// its read in progress, so that interfaces of the group never read in parallel. It returns false when
+// the read did not finish within -scrape-timeout or ctx is done meanwhile.
+func (e *Exporter) waitStale(ctx context.Context, key string) bool {
+    e.staleMutex.Lock()
+    finished, found := e.staleReaders[key]
+    e.staleMutex.Unlock()
+    if !found {
+        return true
+    }
+    var timeout <-chan time.Time
+    if e.scrapeTimeout > 0 {
+        timer := time.NewTimer(e.scrapeTimeout)
+        defer timer.Stop()
+        timeout = timer.C
+    }
+    select {
+        case <-finished:
+            e.staleMutex.Lock()
+            if e.staleReaders[key] == finished {
+                delete(e.staleReaders, key)
+            }
+            e.staleMutex.Unlock()
+            return true
+        case <-ctx.Done():
+        case <-timeout:
+    }
+    return false
+}
+
+// ErrGroupBusy is reported for interfaces skipped because abandoned collection of their serial group is still reading
+var ErrGroupBusy = errors.New("serial group busy: abandoned collection is still reading")
+
+// openModule opens module of interface, failures are remembered for -empty-cage-cache
+func (e *Exporter) openModule(ctx context.Context, iface string) (*sff8472.EthToolModule, error) {
+    if e.emptyCages == nil {
+        return sff8472.NewEthToolModule(iface)
+    }
+    if err, found := e.emptyCages.Get(iface); found {
+        return nil, err
+    }
+    m, err := sff8472.NewEthToolModule(iface)
+    if err != nil && err != sff8472.ErrInterfaceRemoved && ctx.Err() == nil {
+        e.emptyCages.Put(iface, err)
+    }
+    return m, err
+}
+
+// readsIdentityHash returns whether collectIface reads identity hash of module, serial is valid
+// when it is known to pass sff8472.ValidSerial. It is shared with Estimate.
+func (e *Exporter) readsIdentityHash(validSerial bool) bool {
+    return e.exposeEepromHash || (e.eepromHashes != nil && validSerial)
+}
+
+// readsTxrDiag returns whether collectIface reads diagnostics from EEPROM of module with given ddm_type
+func (e *Exporter) readsTxrDiag(ddmType string) bool {
+    return e.diagSource != DIAG_SOURCE_HWMON && ddmType != "none"
+}
+
+// readsHwmon returns whether collectIface reads diagnostics from hwmon after EEPROM returned err
+func (e *Exporter) readsHwmon(err error) bool {
+    return e.diagSource == DIAG_SOURCE_HWMON || (err != nil && e.diagSource == DIAG_SOURCE_AUTO)
+}
+
+// collectIface reads single interface. Interface that disappeared and was not renamed is skipped
+// (nil is returned), with -report-removed it is reported with ErrInterfaceRemoved (transciever_removed).
+// It returns nil also when ctx is done (i.e. collection was abandoned after -scrape-timeout), such
+// collection stops reading and does not update state kept across scrapes.
+func (e *Exporter) collectIface(ctx context.Context, iface string, ifindexes map[string]int, throttle *sff8472.ReadThrottle, diagCache *ScrapeDiagCache) *ifaceRecord {
+    if ctx.Err() != nil {
+        return nil
+    }
+    m, err  := e.openModule(ctx, iface)
+    if err == sff8472.ErrInterfaceRemoved && ctx.Err() == nil {
+        if renamed := e.renamedIface(iface, ifindexes[iface]); renamed != "" {
+            iface = renamed
+            m, err = e.openModule(ctx, iface)
+        } else {
+            if !e.reportRemoved {
+                if e.debug {
+                    fmt.Printf("Interface %s disappeared, skipping\n", iface)
+                }
+                return nil
+            }
+            if e.debug {
+                fmt.Printf("Interface %s disappeared\n", iface)
+            }
+            return &ifaceRecord{ iface: iface, err: err, tags: make(map[string]string), time: time.Now() }
         }
     }
+    var metrics *sff8472.TranscieverDiagnostics
+    var tags    map[string]string
     if err == nil {
-        ch <- prometheus.MustNewConstMetric(transciever_present, prometheus.GaugeValue, 1, labels...)
-        ch <- prometheus.MustNewConstMetric(transciever_temp, prometheus.GaugeValue, metrics.temperature_C,       iface)
-        ch <- prometheus.MustNewConstMetric(transciever_volt, prometheus.GaugeValue, metrics.voltage_V,           iface)
-        ch <- prometheus.MustNewConstMetric(transciever_bias, prometheus.GaugeValue, metrics.bias_mA     * 0.001, iface)
-        ch <- prometheus.MustNewConstMetric(transciever_txw,  prometheus.GaugeValue, metrics.transmit_mW * 0.001, iface)
-        ch <- prometheus.MustNewConstMetric(transciever_rxw,  prometheus.GaugeValue, metrics.receive_mW  * 0.001, iface)
+        m.Throttle = throttle
+        m.Context = ctx
+        m.Debug = e.debug
+        e.validate(iface, m)
+        tags, err = m.ModuleInfo(e.txrInfoFlags)
+        if e.unsupportedAsPresent && errors.Is(err, sff8472.ErrUnsupportedModule) {
+            tags, err = m.BaseIdentity()
+            if err == nil {
+                tags["diag_supported"] = "0"
+            }
+        }
     } else {
-        ch <- prometheus.MustNewConstMetric(transciever_present, prometheus.GaugeValue, 0, labels...)
+        tags = make(map[string]string)
+    }
+    if tags == nil {
+        tags = make(map[string]string)
+    }
+    if rxType := sff8472.RxPowerType(tags["ddm_type"]); rxType != "" {
+        tags["rx_power_type"] = rxType
+    }
+    if _, found := tags["product"]; found {
+        bidi, tx, rx := sff8472.DetectBidi(tags)
+        tags["bidi"] = "0"
+        if bidi {
+            tags["bidi"] = "1"
+        }
+        if tx > 0 {
+            tags["tx_wavelength_nm"] = strconv.Itoa(tx)
+        }
+        if rx > 0 {
+            tags["rx_wavelength_nm"] = strconv.Itoa(rx)
+        }
+    }
+    if !e.netns {
+        if alias := ReadIfalias(iface); alias != "" {
+            tags["alias"] = alias
+        }
+    }
+    checkHash := e.eepromHashes != nil && sff8472.ValidSerial(tags["serial"])
+    var hash string
+    if err == nil && e.readsIdentityHash(sff8472.ValidSerial(tags["serial"])) {
+        // both share one read of identity area
+        if identityHash, hasherr := m.IdentityHash(); hasherr == nil {
+            hash = identityHash
+            if e.exposeEepromHash {
+                tags["eeprom_hash"] = hash[:8]
+            }
+        }
     }
+    if err == nil && e.readsTxrDiag(tags["ddm_type"]) {
+        // transciever without digital diagnostics is reported present with no monitors
+        var reason string
+        metrics, reason, err = diagCache.TxrDiag(m, DiagCacheKey(tags, hash))
+        if err == nil && reason != "" {
+            tags["ddm_unavailable_reason"] = reason
+        }
+        if e.unsupportedAsPresent && errors.Is(err, sff8472.ErrUnsupportedModule) {
+            metrics, err = nil, nil
+            tags["diag_supported"] = "0"
+        }
+    }
+    if ctx.Err() == nil && e.readsHwmon(err) {
+        hwmetrics, hwerr := HwmonDiag(iface)
+        if hwerr == nil {
+            if err != nil {
+                // diagnostics come from hwmon, but EEPROM error (and so missing identity) is still reported
+                tags["eeprom_error"] = err.Error()
+            }
+            metrics, err = hwmetrics, nil
+        } else if err == nil {
+            err = hwerr
+        }
+    }
+    if err == nil && metrics != nil && e.lineSideOffset > 0 && m != nil {
+        metrics.Line, _ = m.LineSideDiag(e.lineSideOffset) // just omitted when it cannot be read
+    }
+    var link *LinkInfo
+    if e.collectLink && ctx.Err() == nil {
+        link, _ = GetLinkSettings(iface) // metrics are just omitted when not supported
+        if link == nil {
+            link = &LinkInfo{}
+        }
+        if !e.netns {
+            ReadLinkState(iface, link)
+        }
+    }
+    if ctx.Err() != nil {
+        // abandoned, result is thrown away
+        return nil
+    }
+    // state kept across scrapes is updated only by collection whose result is used
+    if err == nil {
+        e.firstSeen.Update(iface, tags)
+    }
+    if checkHash && hash != "" {
+        tags["eeprom_changed"] = "0"
+        if e.eepromHashes.Changed(tags["serial"], hash) {
+            tags["eeprom_changed"] = "1"
+        }
+    }
+    if err == nil && metrics != nil {
+        e.tempHistory.Update(iface, tags, metrics.TemperatureC)
+        if e.powerHistograms != nil {
+            e.powerHistograms.Observe(iface, metrics)
+        }
+    }
+    return &ifaceRecord{ iface: iface, err: err, tags: tags, metrics: metrics, link: link, time: time.Now() }
 }
 
-func (ch InfluxChan)Emit(iface string, err error, tags map[string]string, metrics *TranscieverDiagnostics) {
-    tagList := make([]string, 0, len(transcieverFullLabels))
-    for _, label := range(transcieverFullLabels) {
+
+
+func (mc MetricChan)Emit(iface string, err error, tags map[string]string, metrics *sff8472.TranscieverDiagnostics, link *LinkInfo) {
+    e, d := mc.exporter, &mc.exporter.descs
+    il := e.labelValues(e.ifaceLabels, iface, err, tags)
+    labels := e.labelValues(e.presentLabels(), iface, err, tags)
+    if e.stableLabels && err != nil {
+        mc.gauge(d.errorInfo, 1, append(il, sanitizeLabel(err.Error()))...)
+    }
+    mc.gauge(d.removed, boolGauge(err == sff8472.ErrInterfaceRemoved), il...)
+    if eepromErr := tags["eeprom_error"]; eepromErr != "" {
+        mc.gauge(d.eepromError, 1, append(il, sanitizeLabel(eepromErr))...)
+    }
+    if e.inventory != nil {
+        mc.gauge(d.inventoryMatch, e.inventory.Match(iface, tags["serial"]), il...)
+    }
+    if sampled, found := tags["sampled"]; found {
+        mc.gauge(d.sampled, boolGauge(sampled == "1"), il...)
+    }
+    if changed, found := tags["eeprom_changed"]; found {
+        mc.gauge(d.eepromChanged, boolGauge(changed == "1"), il...)
+    }
+    if hasIdentity(tags) {
+        info := append(il, e.labelValues(transcieverInfoLabels, iface, err, tags)...)
+        mc.gauge(d.info, 1, info...)
+        mc.gauge(d.partialRead, boolGauge(tags["partial_read"] != ""), il...)
+        suspect := make(map[string]bool)
+        for _, field := range(strings.Split(tags["suspect"], ",")) {
+            suspect[field] = true
+        }
+        for _, field := range(sff8472.BoundedTags()) {
+            mc.gauge(d.suspect, boolGauge(suspect[field]), append(il, field)...)
+        }
+        if e.unsupportedAsPresent {
+            mc.gauge(d.diagSupported, boolGauge(tags["diag_supported"] != "0"), il...)
+        }
+    }
+    if spec := tags["ext_compliance"]; spec != "" {
+        mc.gauge(d.compliance, 1, append(il, spec)...)
+    }
+    if rev := tags["sff8472_rev"]; rev != "" {
+        mc.gauge(d.sff8472Rev, 1, append(il, rev)...)
+    }
+    if seen, found := e.firstSeen.Get(iface, tags); found && hasIdentity(tags) {
+        mc.gauge(d.firstSeen, float64(seen.UnixNano()) / 1e9, il...)
+    }
+    if mfgdate, ok := sff8472.ParseMfgDate(tags["mfgdate"]); ok {
+        mc.gauge(d.age, mc.collectedAt().Sub(mfgdate).Seconds(), il...)
+    }
+    if options, found := tags["options"]; found {
+        supported := make(map[string]bool)
+        for _, option := range(strings.Split(options + "," + tags["enhanced_options"], ",")) {
+            supported[option] = true
+        }
+        for _, option := range(sff8472.TxrOptionNames()) {
+            mc.gauge(d.option, boolGauge(supported[option]), append(il, option)...)
+        }
+        _, watts := sff8472.PowerClass(options)
+        mc.gauge(d.maxPower, watts, il...)
+        if _, found := tags["enhanced_options"]; found {
+            mc.gauge(d.softTxDisable, boolGauge(supported["soft_tx_disable"]), il...)
+        }
+    }
+    if ddmType, found := tags["ddm_type"]; found {
+        // 0 with ddm_type "none" means optic without diagnostics, otherwise see error label
+        mc.gauge(d.hasDdm, boolGauge(ddmType != "none" && err == nil && metrics != nil), il...)
+    }
+    if reason := tags["ddm_unavailable_reason"]; reason != "" {
+        mc.gauge(d.ddmUnavailable, 1, append(il, reason)...)
+    }
+    if bidi, found := tags["bidi"]; found {
+        mc.gauge(d.bidi, boolGauge(bidi == "1"), il...)
+    }
+    if rxType := tags["rx_power_type"]; rxType != "" {
+        mc.gauge(d.rxPowerType, 1, append(il, rxType)...)
+    }
+    if err == nil {
+        mc.gauge(d.present, 1, labels...)
+    } else {
+        mc.gauge(d.present, 0, labels...)
+    }
+    if link != nil && link.have_settings {
+        mc.gauge(d.linkSpeed, float64(link.speed_Mbps), il...)
+    }
+    if link != nil && link.have_duplex {
+        mc.gauge(d.linkDuplex, boolGauge(link.full_duplex), il...)
+    }
+    if link != nil && link.have_state {
+        mc.gauge(d.linkUp,  boolGauge(link.link_up),  il...)
+        mc.gauge(d.adminUp, boolGauge(link.admin_up), il...)
+    }
+    if err == nil && metrics != nil {
+        if e.lineSideOffset > 0 {
+            mc.monitors(metrics, append(il, "host"))
+            if metrics.Line != nil {
+                mc.monitors(metrics.Line, append(il, "line"))
+            }
+        } else {
+            mc.monitors(metrics, il)
+        }
+        if stat, found := e.tempHistory.Get(iface, tags); found {
+            mc.gauge(d.tempPeak, stat.peak, il...)
+            mc.gauge(d.tempEma,  stat.ema,  il...)
+        }
+        // A2h thresholds are of the same measurement type as receiver power (see rx_power_type),
+        // so average and OMA are never mixed here. Margin of 0 mW would be -Inf, such series is skipped.
+        if threshold := tagFloat(tags, "rx_power_low_warn"); threshold > 0 && metrics.Has(sff8472.DIAG_RX_POWER) && metrics.ReceiveMW > 0 {
+            mc.gauge(d.rxMargin, sff8472.PowerDecibels(metrics.ReceiveMW, threshold),  il...)
+        }
+        if threshold := tagFloat(tags, "tx_power_low_warn"); threshold > 0 && metrics.Has(sff8472.DIAG_TX_POWER) && metrics.TransmitMW > 0 {
+            mc.gauge(d.txMargin, sff8472.PowerDecibels(metrics.TransmitMW, threshold), il...)
+        }
+        if e.linkTxReference != nil && metrics.Has(sff8472.DIAG_RX_POWER) && metrics.ReceiveMW > 0 {
+            mc.gauge(d.loss, *e.linkTxReference - sff8472.PowerDecibels(metrics.ReceiveMW, 1), il...)
+        }
+        if metrics.HaveStatus {
+            mc.gauge(d.txDisable, boolGauge(metrics.TxDisable), il...)
+            mc.gauge(d.txFault,   boolGauge(metrics.TxFault),   il...)
+            mc.gauge(d.rxLos,     boolGauge(metrics.RxLos),     il...)
+        }
+        for _, aux := range(metrics.Aux) {
+            mc.gauge(d.aux, aux.Value, append(il, aux.Type)...)
+        }
+    }
+}
+
+// monitors emits gauges that are present on both sides of optics with retimer
+func (mc MetricChan) monitors(metrics *sff8472.TranscieverDiagnostics, labels []string) {
+    e, d := mc.exporter, &mc.exporter.descs
+    mc.gauge(d.temp, e.tempUnit.Convert(metrics.TemperatureC),  labels...)
+    if metrics.Has(sff8472.DIAG_VOLTAGE) {
+        mc.gauge(d.volt, e.voltUnit.Convert(metrics.VoltageV),  labels...)
+    }
+    if metrics.Has(sff8472.DIAG_BIAS) {
+        mc.gauge(d.bias, metrics.BiasMA * 0.001,                labels...)
+    }
+    if metrics.Has(sff8472.DIAG_TX_POWER) {
+        mc.gauge(d.txw,  e.gaugePowerUnit().Gauge(metrics.TransmitMW), labels...)
+    }
+    if metrics.Has(sff8472.DIAG_RX_POWER) {
+        mc.gauge(d.rxw,  e.gaugePowerUnit().Gauge(metrics.ReceiveMW),  labels...)
+    }
+}
+
+// hasIdentity tells whether tags contain anything read from module EEPROM (alias comes from sysfs,
+// sampled from -sample-fraction, eeprom_error from -diag-source auto)
+func hasIdentity(tags map[string]string) bool {
+    for tag := range(tags) {
+        if tag != "alias" && tag != "sampled" && tag != "eeprom_error" { return true }
+    }
+    return false
+}
+
+// tagFloat returns numeric value of tag, 0 if it is missing or invalid
+func tagFloat(tags map[string]string, name string) float64 {
+    value, err := strconv.ParseFloat(tags[name], 64)
+    if err != nil { return 0 }
+    return value
+}
+
+func boolGauge(b bool) float64 {
+    if b { return 1.0 }
+    return 0.0
+}
+
+func (ic InfluxChan)Emit(iface string, err error, tags map[string]string, metrics *sff8472.TranscieverDiagnostics, link *LinkInfo) {
+    tagList := make([]string, 0, len(transcieverFullLabels) + len(transcieverExtraTags))
+    for _, label := range(append([]string{"iface", "error"}, transcieverTags()...)) {
         var value string
         switch label {
             case "iface": value = iface
@@ -219,18 +1626,62 @@ func (ch InfluxChan)Emit(iface string, err error, tags map[string]string, metric
         }
     }
     tagStr := strings.Join(tagList, ",")
+    fields := []string{"present=0i"}
     if err == nil {
-        ch <- fmt.Sprintf("%v_transciever,%v present=1i,temperature_C=%.2f,voltage_V=%.3f,bias_A=%.6f,receive_power_dBm=%.2f,transmit_power_dBm=%.2f,receive_power_W=%.7f,transmit_power_W=%.7f",
-                    namespace, tagStr,
-                    metrics.temperature_C, metrics.voltage_V, metrics.bias_mA * 0.001,
-                    metrics.receive_dBm, metrics.transmit_dBm, metrics.receive_mW * 0.001, metrics.transmit_mW * 0.001,
-              )
-    } else {
-        ch <- fmt.Sprintf("%v_transciever,%v present=0i",
-                          namespace, tagStr)
+        fields[0] = "present=1i"
+    }
+    if err == nil && metrics != nil {
+        pu, p := ic.power, ic.precision
+        if p.power < 0 {
+            p.power = pu.precision
+        }
+        fields = append(fields, fmt.Sprintf("temperature_C=%.*f", p.temperature, metrics.TemperatureC))
+        if metrics.Has(sff8472.DIAG_VOLTAGE) {
+            fields = append(fields, fmt.Sprintf("voltage_V=%.*f", p.voltage, metrics.VoltageV))
+        }
+        if metrics.Has(sff8472.DIAG_BIAS) {
+            fields = append(fields, fmt.Sprintf("bias_A=%.*f", p.bias, metrics.BiasMA * 0.001))
+        }
+        if metrics.Has(sff8472.DIAG_RX_POWER) {
+            fields = append(fields,
+                fmt.Sprintf("receive_power_%s=%.*f", pu.field, p.power, pu.Field(metrics.ReceiveMW)),
+                fmt.Sprintf("receive_power_W=%.*f", p.power_W, metrics.ReceiveMW * 0.001),
+            )
+        }
+        if metrics.Has(sff8472.DIAG_TX_POWER) {
+            fields = append(fields,
+                fmt.Sprintf("transmit_power_%s=%.*f", pu.field, p.power, pu.Field(metrics.TransmitMW)),
+                fmt.Sprintf("transmit_power_W=%.*f", p.power_W, metrics.TransmitMW * 0.001),
+            )
+        }
+    }
+    if !ic.perMetric {
+        ic.send(fmt.Sprintf("%v_transciever,%v %s", namespace, tagStr, strings.Join(fields, ",")))
+        return
+    }
+    // one measurement per field, i.e. "ethtool_transciever_temperature_C,iface=... value=42.5"
+    for _, field := range(fields) {
+        eq := strings.IndexByte(field, '=')
+        ic.send(fmt.Sprintf("%v_transciever_%s,%v value%s", namespace, field[:eq], tagStr, field[eq:]))
+    }
+}
+
+func (ic InfluxChan) send(line string) {
+    select {
+        case ic.ch <- line:
+        case <-ic.done:
     }
 }
 
+func (ic InfluxChan) EmitStats(stats ScrapeStats) {
+    line := fmt.Sprintf("%v_exporter interfaces_discovered=%di,interfaces_collected=%di",
+                        namespace, stats.discovered, stats.collected)
+    if stats.hottest != "" {
+        line += fmt.Sprintf(",temperature_max_C=%.*f,hottest_iface=%q", ic.precision.temperature, stats.maxTemp_C, stats.hottest)
+    }
+    ic.send(line)
+}
+
 var (
     // Replace various quotes and backslashes in original text
     // with '~' sign,
@@ -241,28 +1692,82 @@ var (
     escapeChars    = regexp.MustCompile("([,=])")
     // Replace control characters and space by escaped space
     whiteChars     = regexp.MustCompile("[[:cntrl:][:space:]]")
+    // Control characters in prometheus label values
+    labelControlChars = regexp.MustCompile(`\p{Cc}`)
+    // Valid prometheus label name, for -relabel
+    labelNameRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
 )
 
-func (e *Exporter) Influxdb(writer io.Writer) {
-    
+// Influxdb writes all interfaces in influx line protocol, error of interface discovery is returned
+func (e *Exporter) Influxdb(ctx context.Context, writer io.Writer) error {
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+
     now := time.Now()
-    nowi := now.UnixNano()
+    nowi := now.UnixNano() / influxTimePrecisions[e.influxTimePrecision].Nanoseconds()
     lines := make(chan string)
+    var collectErr error
     go func () {
-        e.DiscoverAndCollect(InfluxChan(lines))
-        lines <- "\x00EOF"
+        defer close(lines)
+        ic := InfluxChan{ lines, ctx.Done(), e.powerUnit, e.influxPrecision, e.influxPerMetric }
+        var stats ScrapeStats
+        stats, collectErr = e.CollectTo(ctx, ic)
+        if collectErr == nil {
+            ic.EmitStats(stats)
+        }
     } ()
 
-    for line := <-lines; line != "\x00EOF"; line =  <-lines {
-        fmt.Fprintf(writer, "%s %v\n", line, nowi)
+    for line := range(lines) {
+        if ctx.Err() != nil {
+            // reader is gone, just drain the channel until collection stops
+            continue
+        }
+        if _, err := fmt.Fprintf(writer, "%s %v\n", line, nowi); err != nil {
+            // stop collection
+            cancel()
+        }
     }
+    return collectErr
 }
 
 func (e *Exporter) InfluxHandler() (func(http.ResponseWriter, *http.Request)) {
-    return func(w http.ResponseWriter, _ *http.Request) {
-        e.Influxdb(w)
+    return func(w http.ResponseWriter, r *http.Request) {
+        writer, closer := compressedWriter(w, r)
+        defer closer()
+        e.Influxdb(r.Context(), writer)
     }
 }
+
+// acceptsGzip checks Accept-Encoding request header for gzip (with non-zero quality)
+func acceptsGzip(r *http.Request) bool {
+    for _, header := range(r.Header.Values("Accept-Encoding")) {
+        for _, encoding := range(strings.Split(header, ",")) {
+            params := strings.Split(encoding, ";")
+            if strings.TrimSpace(params[0]) != "gzip" {
+                continue
+            }
+            for _, param := range(params[1:]) {
+                if q := strings.TrimSpace(param); q == "q=0" || q == "q=0.0" || q == "q=0.00" || q == "q=0.000" {
+                    return false
+                }
+            }
+            return true
+        }
+    }
+    return false
+}
+
+// compressedWriter wraps response in gzip writer when client accepts it.
+// Returned function must be called to flush compressed stream.
+func compressedWriter(w http.ResponseWriter, r *http.Request) (io.Writer, func()) {
+    w.Header().Add("Vary", "Accept-Encoding")
+    if !acceptsGzip(r) {
+        return w, func() {}
+    }
+    w.Header().Set("Content-Encoding", "gzip")
+    gz := gzip.NewWriter(w)
+    return gz, func() { gz.Close() }
+}
 // }}}
 
 type arrayFlags []string // {{{
@@ -275,72 +1780,396 @@ func (a *arrayFlags) Set(value string) error {
 }
 // }}
 
+// compileFlagRegex compiles user supplied regular expression of flag, invalid one ends program with exit code 2
+func compileFlagRegex(flagName, pattern string) *regexp.Regexp {
+    re, err := regexp.Compile(pattern)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Error: invalid regular expression of -%s '%s': %v\n", flagName, pattern, err)
+        os.Exit(2)
+    }
+    return re
+}
+
+// printGathered prints metrics of gatherer to stdout in prometheus text format
+func printGathered(gth prometheus.Gatherer) {
+    mfs, err := gth.Gather()
+    enc := expfmt.NewEncoder(os.Stdout, expfmt.FmtText)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+    }
+    for _, mf := range mfs {
+        err = enc.Encode(mf)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+        }
+    }
+}
+
 func main() { // {{{
     var (
         test     = flag.Bool("test", false, "test run - gather methrics and print them")
+        testPrometheus = flag.Bool("test-prometheus", false, "test run - gather and print only transciever methrics, without go, process and version ones")
+        outputTemplate = flag.String("output-template", "", "single run - print interfaces using go text/template, i.e.\n" +
+                        "'{{.Iface}} {{.Tags.vendor}} {{with .Metrics}}{{.TemperatureC}}{{end}}{{.Error}}'")
         influx   = flag.Bool("test-influx", false, "single run - gather methrics and print them in influx line format")
+        dumpEeprom = flag.String("dump-eeprom", "", "print hex dump of raw module EEPROM of given interface, then exit")
+        selfCheck = flag.String("self-check", "", "compare decoded identity and monitors of given interface with output of\n" +
+                        "system \"ethtool -m\", print mismatches and exit nonzero when there are any")
+        estimate = flag.Bool("estimate", false, "print number of ioctls and rough duration of scrape of discovered interfaces\n" +
+                        "grouped by -parallel, without reading diagnostics, then exit")
+        listIfaces = flag.Bool("list-ifaces", false, "print discovered interfaces and whether they report a module, then exit")
         addr     = flag.String("web.listen-address", "127.0.0.1:9992", "The address to listen on for HTTP requests.")
         debug    = flag.Bool("debug", false, "test run with debug printing (currently only iface glob match)")
-        parallel = flag.String("parallel", "^(.*)$", "regular expression that matches inteface name - " +
-                        "Interfaces that differ in capture groups are collected in parallel.\n" +
-                        "I.e. \"^(.*)\" means full parallel, \"^(.*[^0-9])\" means enp1s2f0 and enp1s2f1\n" +
-                        " are collected in series but parallel with another series enp1s3f0 and enp1s3f1.",
-                   )
+        maxParallel = flag.Int("max-parallel", 0, "maximal number of serial groups (see -parallel) collected at once, 0 is unlimited")
+        diagSource = flag.String("diag-source", "ethtool", "source of transciever diagnostics: ethtool, hwmon or auto\n" +
+                        "(auto uses hwmon only when ethtool ioctl fails, its error is kept in transciever_eeprom_error_info)")
+        stableLabels = flag.Bool("stable-labels", false, "export error as separate " + namespace + "_transciever_error_info metric,\n" +
+                        "so that transciever_present keeps the same label set")
+        units    = flag.String("units", "C,V", "units of prometheus temperature (C or K) and voltage (V or mV) gauges")
+        powerUnit = flag.String("power-unit", "dbm", "unit of optical power: dbm, dbuw or mw; influx fields are exported in this unit\n" +
+                                "besides W, prometheus gauges are in W for dbm")
+        powerPrimary = flag.String("power-primary", "watts", "unit of prometheus power gauges: watts (in -power-unit, W for dbm)\n" +
+                                "or dbm (transciever_txw_dbm and transciever_rxw_dbm), influx is not affected")
+        cageRegex = flag.String("cage-regex", "", "regular expression that matches interface name - adds \"cage\" label\n" +
+                        "with concatenated capture groups, i.e. \"^(.*?)(?:s[0-9]+)?$\" maps breakout enp1s0f0s1 to cage enp1s0f0")
+        readInterval = flag.Duration("read-interval", 0, "minimal delay between consecutive EEPROM reads within one serial group\n" +
+                        "(see -parallel), i.e. for ports sharing one I2C bus")
+        scrapeInterval = flag.Duration("scrape-interval", 0, "scrape transcievers in background with this period and serve\n" +
+                        "last results (default 0 - scrape on each request)")
+        maxAge   = flag.Duration("max-age", 0, "with -scrape-interval, stop exporting interfaces not collected\n" +
+                        "for this long (default 0 - twice the scrape interval)")
+        checkEeprom = flag.Bool("check-eeprom", false, "read identity EEPROM area on every scrape and report optics whose content\n" +
+                        "differs from the first one seen with the same serial")
+        exposeEepromHash = flag.Bool("expose-eeprom-hash", false, "add eeprom_hash label (first 8 hex digits of SHA-256 of identity EEPROM area)\n" +
+                        "to transciever_info, for grouping decode bugs by EEPROM content; reads the area on every scrape")
+        dualSide = flag.Uint("dual-side", 0, "EEPROM offset (i.e. 0x1e0) of line side monitors of optics with retimer or gearbox,\n" +
+                        "they are exported with side=\"line\" label (prometheus only), 0 disables it")
+        powerHistograms = flag.Bool("power-histograms", false, "export native histograms (with classic buckets) of rx and tx power (dBm)\n" +
+                        "accumulated over scrapes, keeps state of every interface ever seen")
+        unsupportedAsPresent = flag.Bool("unsupported-as-present", false, "report modules of unsupported type (i.e. QSFP, DAC) as present\n" +
+                        "with vendor, product and serial and diag_supported=\"0\" label, instead of an error")
+        reportRemoved = flag.Bool("report-removed", false, "report interface that vanished during scrape (and was not renamed) with present 0\n" +
+                        "and transciever_removed 1, by default it is skipped")
+        linkTxReference = flag.String("link-tx-reference", "", "assumed transmit power of far end (dBm), exports link loss estimate\n" +
+                        "as difference between it and receiver power")
+        scrapeTimeout = flag.Duration("scrape-timeout", 0, "abandon interface whose collection takes longer and report timeout error,\n" +
+                        "so that remaining interfaces of its serial group are collected (default 0 - no limit)")
+        emptyCageCache = flag.Duration("empty-cage-cache", 0, "do not retry interface whose module could not be opened (i.e. empty cage)\n" +
+                        "for this long, its last error is reported instead (default 0 - retry every scrape)")
+        collectDeadline = flag.Duration("collect-deadline", 0, "stop collection of all interfaces after this time and report remaining ones\n" +
+                        "with \"deadline exceeded\" error, i.e. below Prometheus scrape_timeout (default 0 - no limit)")
+        collectLink = flag.Bool("collect-link", false, "also export link speed and duplex (ETHTOOL_GLINKSETTINGS)\n" +
+                       "and operational and administrative state of interface")
+        failIfEmpty = flag.Bool("fail-if-empty", false, "exit with error at start when no interface is found (i.e. mistyped -devices glob)")
+        enablePprof = flag.Bool("pprof", false, "serve profiling data of exporter under /debug/pprof/")
+        sampleFraction = flag.Float64("sample-fraction", 1, "collect only this fraction of interfaces in each scrape, round-robin,\n" +
+                        "the other interfaces repeat their last result (see ethtool_transciever_sampled)")
+        inventoryFile = flag.String("inventory-file", "", "file with lines \"iface serial\" of expected optics, exported as\n" +
+                        "ethtool_transciever_inventory_match, reloaded on SIGHUP")
+        warmUp   = flag.Bool("warm-up", false, "read static info of all interfaces into cache in background after start,\n" +
+                               "so that the first scrape is not slow (see ethtool_cache_entries)")
+        auxMonitors = flag.Bool("aux-monitors", false, "export AUX1/AUX2 monitors (laser temperature, TEC current, ...) as transciever_aux,\n" +
+                        "their types are read from A0h byte 98 in vendor specific area, so enable only for optics using it")
+        noCache  = flag.Bool("no-cache", false, "do not cache module info by serial number, read it on every scrape")
+        cacheFields = flag.String("cache-fields", "", "comma separated list of module info fields cached by serial number,\n" +
+                        "the others are read on every scrape (default all fields)")
+        influxPrecision = flag.String("influx-precision", "", "decimal places of influx fields as comma separated field=digits,\n" +
+                        "fields are temperature, voltage, bias, power and power_W, i.e. \"power=3,power_W=9\"")
+        influxTimePrecision = flag.String("influx-precision-time", "ns", "unit of influx timestamps: s, ms, us or ns, also sent as precision\n" +
+                        "parameter of -influx-push-url")
+        influxStyle = flag.String("influx-measurement-style", "single", "single: one ethtool_transciever measurement with all fields,\n" +
+                        "per-metric: measurement per field, i.e. ethtool_transciever_temperature_C with field value")
+        influxPushUrl = flag.String("influx-push-url", "", "with -scrape-interval, POST influx lines after every scrape to this\n" +
+                        "write endpoint, i.e. http://localhost:8086/write or http://localhost:8086/api/v2/write")
+        influxDb = flag.String("influx-db", "", "database of -influx-push-url (InfluxDB 1.x)")
+        influxOrg = flag.String("influx-org", "", "organization of -influx-push-url (InfluxDB 2.x)")
+        influxBucket = flag.String("influx-bucket", "", "bucket of -influx-push-url (InfluxDB 2.x)")
+        influxToken = flag.String("influx-token", "", "authorization token of -influx-push-url")
+        statsdAddress = flag.String("statsd-address", "", "with -scrape-interval, send gauges with dogstatsd tags after every scrape\n" +
+                        "to this UDP address, i.e. localhost:8125")
+        netns    = flag.String("netns", "", "network namespace (name or path) of scraped interfaces, requires CAP_SYS_ADMIN\n" +
+                        "(alias, link state and hwmon are read from sysfs, so they are not available)")
         pathGlob arrayFlags
+        ifaceNames arrayFlags
+        forceType arrayFlags
+        identifierLayouts arrayFlags
+        fields   arrayFlags
+        vendorFields arrayFlags
+        relabels arrayFlags
+        parallel arrayFlags
+        clei     = flag.Bool("clei", false, "decode CLEI code of module as tag clei (empty when module has none)")
+        cleiOffset = flag.Uint("clei-offset", 0x60, "offset of CLEI code in A0h page, default is start of vendor specific area")
         defaultPath = []string { "/sys/bus/pci/drivers/ixgbe/*:*/net/*" }
     )
     flag.Var(&pathGlob, "devices",
-        "Shell glob that enumerate network devices to scrap. Repeatable.\n" + 
+        "Shell glob that enumerate network devices to scrap. Repeatable, value may also contain\n" +
+        "comma separated list of globs.\n" +
         "Last component must resolve to name of network device. Default: " + strings.Join(defaultPath, ", "),
     )
+    flag.Var(&ifaceNames, "iface",
+        "Name of network device to scrap, in addition to -devices globs. Repeatable.\n" +
+        "Default -devices are not used when -iface is given.",
+    )
+    flag.Var(&forceType, "force-type",
+        "Override module type detected for interface, i.e. enp1s0f0=SFF-8472. Repeatable.",
+    )
+    flag.Var(&identifierLayouts, "identifier-layout",
+        "Decode optics with given SFF-8024 identifier (EEPROM byte 0) using layout of module type,\n" +
+        "regardless of type reported by driver, i.e. 0x11=SFF-8636. Repeatable.",
+    )
+    flag.Var(&fields, "field",
+        "Extra EEPROM field exported as tag, name:offset:length:decoder with decoder one of\n" +
+        "string, int, oui, hex, clei. Offset is within A0h page, i.e. asset_tag:0x60:16:string. Repeatable.",
+    )
+    flag.Var(&parallel, "parallel",
+        "Regular expression that matches inteface name - " +
+        "Interfaces that differ in capture groups are collected in parallel.\n" +
+        "I.e. \"^(.*)\" means full parallel, \"^(.*[^0-9])\" means enp1s2f0 and enp1s2f1\n" +
+        " are collected in series but parallel with another series enp1s3f0 and enp1s3f1.\n" +
+        "Repeatable, capture groups of all patterns are combined in given order, so interfaces are collected\n" +
+        "in series only when every pattern captures the same (non-matching counts as one more value).\n" +
+        "Default: ^(.*)$",
+    )
+    flag.Var(&relabels, "relabel",
+        "Rename label of per interface metrics, old=new, i.e. iface=interface or product=part_number. Repeatable.",
+    )
+    flag.Var(&vendorFields, "vendor-page-field",
+        "Extra EEPROM field exported as tag, like -field, but offset is within vendor specific area\n" +
+        "of A2h page (0x80-0xff), i.e. temp2:0x80:2:int. Skipped for modules without A2h page. Repeatable.",
+    )
     flag.Parse()
-    if len(pathGlob) == 0 {
+    if len(pathGlob) == 0 && len(ifaceNames) == 0 {
         pathGlob = defaultPath
     }
 
-    exporter, err := NewExporter(pathGlob, *debug, regexp.MustCompile(*parallel))
+    if *exposeEepromHash {
+        transcieverInfoLabels = append(transcieverInfoLabels, "eeprom_hash")
+    }
+    if *clei {
+        fields = append(fields, fmt.Sprintf("clei:0x%02x:%d:clei", *cleiOffset, sff8472.CLEI_LENGTH))
+    }
+    for i, spec := range(append(fields, vendorFields...)) {
+        parse := sff8472.ParseEepromField
+        if i >= len(fields) {
+            parse = sff8472.ParseVendorPageField
+        }
+        def, err := parse(spec)
+        if err == nil {
+            err = sff8472.AddEepromField(def)
+        }
+        if err != nil { panic(err) }
+        transcieverFullLabels = append(transcieverFullLabels, def.Name())
+        transcieverInfoLabels = append(transcieverInfoLabels, def.Name())
+    }
+
+    if len(parallel) == 0 {
+        parallel = arrayFlags{ "^(.*)$" }
+    }
+    parallelPatterns := make([]*regexp.Regexp, len(parallel))
+    for i, pattern := range(parallel) {
+        parallelPatterns[i] = compileFlagRegex("parallel", pattern)
+    }
+    exporter, err := NewExporter(pathGlob, *debug, parallelPatterns)
+    if err != nil { panic(err) }
+    exporter.ifaceNames = ifaceNames
+    exporter.diagSource, err = ParseDiagSource(*diagSource)
+    if err != nil { panic(err) }
+    exporter.SetStableLabels(*stableLabels)
+    exporter.SetMaxParallel(*maxParallel)
+    exporter.SetDualSide(uint32(*dualSide))
+    exporter.SetSampleFraction(*sampleFraction)
+    if *inventoryFile != "" {
+        exporter.inventory, err = NewInventory(*inventoryFile)
+        if err != nil { panic(err) }
+    }
+    if *cageRegex != "" {
+        exporter.SetCageRegex(compileFlagRegex("cage-regex", *cageRegex))
+    }
+    // after every setter that changes labels, so that all collisions are found
+    if err := exporter.SetRelabel(relabels); err != nil { panic(err) }
+    exporter.readInterval = *readInterval
+    exporter.collectLink = *collectLink
+    exporter.scrapeTimeout = *scrapeTimeout
+    exporter.collectDeadline = *collectDeadline
+    if *emptyCageCache > 0 {
+        exporter.emptyCages = NewEmptyCages(*emptyCageCache)
+    }
+    exporter.unsupportedAsPresent = *unsupportedAsPresent
+    exporter.reportRemoved = *reportRemoved
+    if *linkTxReference != "" {
+        reference, err := strconv.ParseFloat(*linkTxReference, 64)
+        if err != nil { panic(err) }
+        if math.IsNaN(reference) || math.IsInf(reference, 0) {
+            panic(fmt.Errorf("Invalid link tx reference '%s', expected finite dBm", *linkTxReference))
+        }
+        exporter.linkTxReference = &reference
+    }
+    exporter.exposeEepromHash = *exposeEepromHash
+    if *checkEeprom {
+        exporter.eepromHashes = NewEepromHashes()
+    }
+    if *powerHistograms {
+        exporter.powerHistograms = NewPowerHistograms(exporter.relabeled("iface"))
+    }
+    if err := exporter.SetUnits(*units); err != nil { panic(err) }
+    if err := exporter.SetPowerUnit(*powerUnit); err != nil { panic(err) }
+    if err := exporter.SetPowerPrimary(*powerPrimary); err != nil { panic(err) }
+    exporter.influxPrecision, err = parseInfluxPrecision(*influxPrecision)
     if err != nil { panic(err) }
-    if _, err := exporter.GetIfaces(); err != nil {
+    if _, found := influxTimePrecisions[*influxTimePrecision]; !found {
+        panic(fmt.Errorf("Invalid influx time precision '%s'", *influxTimePrecision))
+    }
+    exporter.influxTimePrecision = *influxTimePrecision
+    switch *influxStyle {
+        case "single":
+        case "per-metric": exporter.influxPerMetric = true
+        default: panic(fmt.Errorf("Invalid influx measurement style '%s'", *influxStyle))
+    }
+    if err := exporter.SetNetns(*netns); err != nil { panic(err) }
+    sff8472.ModuleCacheDisabled = *noCache
+    sff8472.AuxMonitorsEnabled = *auxMonitors
+    if *cacheFields != "" {
+        if err := sff8472.SetCacheFields(strings.Split(*cacheFields, ",")); err != nil { panic(err) }
+    }
+    for _, force := range(forceType) {
+        eq := strings.Index(force, "=")
+        if eq < 0 { panic(fmt.Errorf("Invalid -force-type '%s', expected iface=TYPE", force)) }
+        tpe, err := sff8472.ParseModuleType(force[eq+1:])
+        if err != nil { panic(err) }
+        sff8472.ModuleTypeOverrides[force[:eq]] = tpe
+    }
+    for _, spec := range(identifierLayouts) {
+        if err := sff8472.ParseIdentifierLayout(spec); err != nil { panic(err) }
+    }
+
+    if *selfCheck != "" {
+        mismatches, err := SelfCheck(os.Stdout, *selfCheck)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+            os.Exit(2)
+        }
+        if mismatches > 0 {
+            os.Exit(1)
+        }
+        fmt.Printf("%s: decoded values match ethtool -m\n", *selfCheck)
+        os.Exit(0)
+        return
+    }
+
+    if *dumpEeprom != "" {
+        if err := DumpEeprom(os.Stdout, *dumpEeprom); err != nil {
+            fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+            os.Exit(1)
+        }
+        os.Exit(0)
+        return
+    }
+
+    ifaces, err := exporter.GetIfaces()
+    if err != nil {
         panic(err)
     }
+    if *failIfEmpty && len(ifaces) == 0 {
+        fmt.Fprintf(os.Stderr, "Error: no interface matches -devices globs %v nor -iface names\n", pathGlob)
+        os.Exit(1)
+    }
+
+    if *listIfaces {
+        exporter.ListIfaces(os.Stdout, ifaces)
+        os.Exit(0)
+        return
+    }
+
+    if *estimate {
+        exporter.Estimate(os.Stdout, ifaces)
+        os.Exit(0)
+        return
+    }
+
+    if *outputTemplate != "" {
+        tmpl, err := ParseOutputTemplate(*outputTemplate)
+        if err != nil { panic(err) }
+        if err := exporter.Template(context.Background(), tmpl, os.Stdout); err != nil { panic(err) }
+        os.Exit(0)
+        return
+    }
 
     if *influx {
-        exporter.Influxdb(os.Stdout);
+        if err := exporter.Influxdb(context.Background(), os.Stdout); err != nil { panic(err) }
         os.Exit(0);
         return
     }
 
+    if *testPrometheus {
+        // Gather only exporter's own metrics, without version, go and process collectors
+        registry := prometheus.NewRegistry()
+        registry.MustRegister(exporter)
+        printGathered(registry)
+        return
+    }
+
     prometheus.MustRegister(exporter)
     prometheus.MustRegister(version.NewCollector(namespace))
 
     if *test || *debug {
         // Run full prometheus gather and print to stdout
-        gth := prometheus.DefaultGatherer
-        mfs, err := gth.Gather()
-        enc := expfmt.NewEncoder(os.Stdout, expfmt.FmtText)
-        if err != nil {
-            fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-        }
-        for _, mf := range mfs {
-            err = enc.Encode(mf)
-            if err != nil {
-                fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-            }
-        }
+        printGathered(prometheus.DefaultGatherer)
         return
     } else {
-        http.Handle("/metrics", promhttp.Handler())
-        http.HandleFunc("/influx", exporter.InfluxHandler())
-        http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+        if *scrapeInterval > 0 {
+            if *maxAge <= 0 {
+                *maxAge = 2 * *scrapeInterval
+            }
+            if *influxPushUrl != "" {
+                precision := *influxTimePrecision
+                if precision == "ns" {
+                    precision = "" // default of InfluxDB, keeps write url as it was given
+                }
+                exporter.pusher, err = NewInfluxPusher(*influxPushUrl, *influxDb, *influxOrg, *influxBucket, *influxToken, precision)
+                if err != nil { panic(err) }
+            }
+            if *statsdAddress != "" {
+                exporter.statsd, err = NewStatsDChan(*statsdAddress)
+                if err != nil { panic(err) }
+            }
+            exporter.ScrapeInBackground(*scrapeInterval, *maxAge)
+        } else if *influxPushUrl != "" {
+            panic(fmt.Errorf("-influx-push-url requires -scrape-interval"))
+        } else if *statsdAddress != "" {
+            panic(fmt.Errorf("-statsd-address requires -scrape-interval"))
+        }
+        exporter.FlushOnSighup()
+        // own mux, as net/http/pprof registers itself on the default one
+        mux := http.NewServeMux()
+        mux.Handle("/metrics", exporter.MetricsHandler())
+        mux.HandleFunc("/influx", exporter.InfluxHandler())
+        mux.HandleFunc("/influx.jsonl", exporter.JSONLinesHandler())
+        mux.HandleFunc("/csv", exporter.CSVHandler())
+        if *enablePprof {
+            mux.HandleFunc("/debug/pprof/", pprof.Index)
+            mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+            mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+            mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+            mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+        }
+        mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
             w.Write([]byte(`<html>
   <head><title>NetHW Exporter</title></head>
   <body><h1>NetHW Exporter</h1>
   <p><a href="/metrics">Metrics</a></p>
   <p><a href="/influx">Metrics in influxdb format</a></p>
+  <p><a href="/influx.jsonl">Metrics as streamed JSON lines</a></p>
+  <p><a href="/csv">Transcievers as CSV</a></p>
 </html>
 `))
         })
-        err := http.ListenAndServe(*addr, nil)
+        listener, err := net.Listen("tcp", *addr)
+        if err == nil {
+            if *warmUp {
+                go exporter.WarmUpCache()
+            }
+            err = http.Serve(listener, mux)
+        }
         if (err != nil) {
             fmt.Fprintf(os.Stderr, "Error: %v\n", err)
             os.Exit(1)
@@ -0,0 +1,555 @@
+package main
+// vim: set et sw=4 :
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "net/http/httptest"
+    "os"
+    "os/signal"
+    "path/filepath"
+    "reflect"
+    "runtime"
+    "sync"
+    "sync/atomic"
+    "syscall"
+    "testing"
+    "time"
+
+    "github.com/ebikt/ethtool-exporter/sff8472"
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// newTestExporter returns exporter with default configuration
+func newTestExporter(t *testing.T, pathGlob ...string) *Exporter {
+    e, err := NewExporter(pathGlob, false, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return e
+}
+
+func TestGetIfacesTrailingSlash(t *testing.T) {
+    net := filepath.Join(t.TempDir(), "sys", "class", "net")
+    for _, iface := range([]string{"eth0", "eth1", "eth10", "lo"}) {
+        if err := os.MkdirAll(filepath.Join(net, iface), 0755); err != nil {
+            t.Fatal(err)
+        }
+    }
+    expect := []string{"eth0", "eth1", "eth10"}
+    for _, glob := range([]string{net + "/eth*", net + "/eth*/", net + "/eth*//"}) {
+        ifaces, err := newTestExporter(t, glob).GetIfaces()
+        if err != nil {
+            t.Fatalf("%s: %v", glob, err)
+        }
+        if !reflect.DeepEqual(ifaces, expect) {
+            t.Errorf("%s resolved to %v, expected %v", glob, ifaces, expect)
+        }
+    }
+}
+
+// failingWriter is response whose client disconnected, every write fails
+type failingWriter struct {
+    *httptest.ResponseRecorder
+    writes int32
+}
+
+func (w *failingWriter) Write(data []byte) (int, error) {
+    atomic.AddInt32(&w.writes, 1)
+    return 0, errors.New("connection reset by peer")
+}
+
+func TestInfluxdbStopsOnWriteError(t *testing.T) {
+    e := newTestExporter(t)
+    // interfaces with remembered open error are collected without touching hardware
+    e.emptyCages = NewEmptyCages(time.Hour)
+    for i := range(make([]struct{}, 200)) {
+        iface := fmt.Sprintf("test%d", i)
+        e.ifaceNames = append(e.ifaceNames, iface)
+        e.emptyCages.Put(iface, errors.New("no module"))
+    }
+    goroutines := runtime.NumGoroutine()
+
+    w := &failingWriter{ ResponseRecorder: httptest.NewRecorder() }
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+        e.InfluxHandler()(w, httptest.NewRequest("GET", "/influx", nil))
+    }()
+    select {
+        case <-done:
+        case <-time.After(10 * time.Second):
+            t.Fatal("Influx handler did not return after write error")
+    }
+
+    if writes := atomic.LoadInt32(&w.writes); writes != 1 {
+        t.Errorf("%d writes after the first failed one, expected none", writes - 1)
+    }
+    if e.lastScrapeError != context.Canceled.Error() {
+        t.Errorf("scrape was not cancelled, last scrape error is '%s'", e.lastScrapeError)
+    }
+    deadline := time.Now().Add(5 * time.Second)
+    for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+        time.Sleep(10 * time.Millisecond)
+    }
+    if leaked := runtime.NumGoroutine() - goroutines; leaked > 0 {
+        t.Errorf("%d goroutines leaked", leaked)
+    }
+}
+
+func TestGaugeWrongArity(t *testing.T) {
+    e := newTestExporter(t)
+    ch := make(chan prometheus.Metric, 1)
+    mc := MetricChan{ ch: ch, exporter: e }
+    // transciever_present has iface, error and identity labels, so one value is too few
+    mc.gauge(e.descs.present, 1, "eth0")
+    if len(ch) != 0 {
+        t.Errorf("series with wrong number of labels was emitted")
+    }
+
+    registry := prometheus.NewRegistry()
+    registry.MustRegister(e)
+    mfs, err := registry.Gather()
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, mf := range(mfs) {
+        if mf.GetName() != namespace + "_collect_errors_total" {
+            continue
+        }
+        for _, metric := range(mf.GetMetric()) {
+            for _, label := range(metric.GetLabel()) {
+                if label.GetName() == "reason" && label.GetValue() == "metric_build" {
+                    if value := metric.GetCounter().GetValue(); value != 1 {
+                        t.Errorf("collect_errors_total{reason=\"metric_build\"} is %v, expected 1", value)
+                    }
+                    return
+                }
+            }
+        }
+    }
+    t.Errorf("collect_errors_total{reason=\"metric_build\"} was not exported")
+}
+
+// recordingEmiter remembers errors of emitted interfaces
+type recordingEmiter struct {
+    mutex  sync.Mutex
+    errors map[string]error
+}
+
+func (r *recordingEmiter) Emit(iface string, err error, tags map[string]string, metrics *sff8472.TranscieverDiagnostics, link *LinkInfo) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    r.errors[iface] = err
+}
+
+func TestSerialGroupWaitsForStaleReader(t *testing.T) {
+    e := newTestExporter(t)
+    e.scrapeTimeout = 20 * time.Millisecond
+    e.emptyCages = NewEmptyCages(time.Hour)
+    ifaces := []string{"test0", "test1"}
+    for _, iface := range(ifaces) {
+        e.emptyCages.Put(iface, errors.New("no module"))
+    }
+    // collection abandoned in previous scrape is still stuck in read
+    stuck := make(chan struct{})
+    e.staleReaders[e.serialKey(ifaces[0])] = stuck
+
+    out := &recordingEmiter{ errors: make(map[string]error) }
+    e.CollectIfacesSerially(context.Background(), ifaces, nil, nil, out)
+    for _, iface := range(ifaces) {
+        if out.errors[iface] != ErrGroupBusy {
+            t.Errorf("%s: error %v while stale reader is stuck, expected %v", iface, out.errors[iface], ErrGroupBusy)
+        }
+    }
+
+    close(stuck)
+    out = &recordingEmiter{ errors: make(map[string]error) }
+    e.CollectIfacesSerially(context.Background(), ifaces, nil, nil, out)
+    for _, iface := range(ifaces) {
+        if err := out.errors[iface]; err == nil || err.Error() != "no module" {
+            t.Errorf("%s: error %v after stale reader finished, expected its own error", iface, err)
+        }
+    }
+    if len(e.staleReaders) != 0 {
+        t.Errorf("finished stale reader was not forgotten")
+    }
+}
+
+func TestDiscoverAndCollectGlobError(t *testing.T) {
+    e := newTestExporter(t, "/sys/class/net/[")
+    out := &recordingEmiter{ errors: make(map[string]error) }
+    stats, err := e.DiscoverAndCollect(context.Background(), out)
+    if err != filepath.ErrBadPattern {
+        t.Errorf("DiscoverAndCollect returned %v, expected %v", err, filepath.ErrBadPattern)
+    }
+    if stats.discovered != 0 || len(out.errors) != 0 {
+        t.Errorf("%d interfaces discovered and %d emitted after discovery failed", stats.discovered, len(out.errors))
+    }
+    if e.lastScrapeError != filepath.ErrBadPattern.Error() {
+        t.Errorf("last scrape error is '%s', expected '%v'", e.lastScrapeError, filepath.ErrBadPattern)
+    }
+}
+
+func TestSetRelabel(t *testing.T) {
+    tests := []struct {
+        specs []string
+        valid bool
+    }{
+        { []string{"iface=interface", "product=part_number"}, true },
+        { []string{"field=eeprom_field"},                     true },
+        { []string{"iface=interface", "iface=device"},        false }, // relabeled twice
+        { []string{"iface=0iface"},                           false }, // invalid name
+        { []string{"iface"},                                  false },
+        { []string{"ifname=interface"},                       false }, // unknown label
+        { []string{"cage=slot"},                              false }, // no -cage-regex
+        { []string{"product=vendor"},                         false }, // collides in transciever_present
+        { []string{"iface=field"},                            false }, // collides in transciever_suspect only
+    }
+    for _, test := range(tests) {
+        e := newTestExporter(t)
+        err := e.SetRelabel(test.specs)
+        if (err == nil) != test.valid {
+            t.Errorf("SetRelabel(%v) returned %v", test.specs, err)
+        }
+        if err != nil && len(e.relabel) != 0 {
+            t.Errorf("SetRelabel(%v) failed, but relabel %v is kept", test.specs, e.relabel)
+        }
+    }
+}
+
+// constCollector collects given metrics
+type constCollector []prometheus.Metric
+
+func (c constCollector) Describe(ch chan<- *prometheus.Desc) {
+    prometheus.DescribeByCollect(c, ch)
+}
+
+func (c constCollector) Collect(ch chan<- prometheus.Metric) {
+    for _, metric := range(c) {
+        ch <- metric
+    }
+}
+
+func TestRelabelGlobalDescs(t *testing.T) {
+    e := newTestExporter(t)
+    if err := e.SetRelabel([]string{"iface=interface"}); err != nil {
+        t.Fatal(err)
+    }
+    e.powerHistograms = NewPowerHistograms(e.relabeled("iface"))
+    e.powerHistograms.Observe("eth0", &sff8472.TranscieverDiagnostics{ ReceiveDBm: -3, TransmitDBm: -2 })
+    registry := prometheus.NewPedanticRegistry()
+    registry.MustRegister(e.powerHistograms)
+    registry.MustRegister(constCollector{ prometheus.MustNewConstMetric(e.descs.tempMax, prometheus.GaugeValue, 40, "eth0") })
+    mfs, err := registry.Gather()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(mfs) != 3 {
+        t.Errorf("%d metric families gathered, expected 3", len(mfs))
+    }
+    for _, mf := range(mfs) {
+        for _, metric := range(mf.GetMetric()) {
+            for _, label := range(metric.GetLabel()) {
+                if label.GetName() != "interface" {
+                    t.Errorf("%s has label '%s' after iface=interface", mf.GetName(), label.GetName())
+                }
+            }
+        }
+    }
+}
+
+// fakeDiagOptic serves diagnostics of one optic and counts its reads
+type fakeDiagOptic struct {
+    tags  map[string]string // module info
+    temp  float64
+    reads int
+}
+
+func (o *fakeDiagOptic) TxrDiag() (*sff8472.TranscieverDiagnostics, error) {
+    o.reads++
+    return &sff8472.TranscieverDiagnostics{ TemperatureC: o.temp }, nil
+}
+
+func (o *fakeDiagOptic) DdmUnavailableReason() string { return "" }
+func (o *fakeDiagOptic) Abandoned() error { return nil }
+
+func TestScrapeDiagCacheDuplicateSerial(t *testing.T) {
+    info := func(vendor string) map[string]string {
+        return map[string]string{ "serial": "FNS12345", "vendor": vendor, "product": "SFP-10G-LR", "oui": "00:1b:21" }
+    }
+    first := &fakeDiagOptic{ tags: info("VENDOR A"), temp: 30 }
+    breakout := &fakeDiagOptic{ tags: info("VENDOR A"), temp: 99 }
+    other := &fakeDiagOptic{ tags: info("VENDOR B"), temp: 50 }
+    rehashed := &fakeDiagOptic{ tags: info("VENDOR A"), temp: 60 }
+    c := &ScrapeDiagCache{ diags: make(map[string]scrapeDiag) }
+    tests := []struct {
+        name   string
+        optic  *fakeDiagOptic
+        hash   string
+        expect float64
+    }{
+        { "first",     first,    "",     30 },
+        { "breakout",  breakout, "",     30 }, // same optic, read only once
+        { "duplicate", other,    "",     50 }, // other optic with the same serial
+        { "hashed",    first,    "aaaa", 30 },
+        { "rehashed",  rehashed, "bbbb", 60 }, // identity area differs beyond module info
+    }
+    for _, test := range(tests) {
+        metrics, _, err := c.TxrDiag(test.optic, DiagCacheKey(test.optic.tags, test.hash))
+        if err != nil {
+            t.Fatalf("%s: %v", test.name, err)
+        }
+        if metrics.TemperatureC != test.expect {
+            t.Errorf("%s: temperature %v, expected %v", test.name, metrics.TemperatureC, test.expect)
+        }
+    }
+    if breakout.reads != 0 || other.reads != 1 || rehashed.reads != 1 {
+        t.Errorf("breakout read %d times, duplicate serial read %d and %d times, expected 0, 1 and 1",
+            breakout.reads, other.reads, rehashed.reads)
+    }
+    // without valid serial nothing is shared
+    if key := DiagCacheKey(map[string]string{ "serial": "        " }, ""); key != "" {
+        t.Errorf("blank serial has diag cache key %q", key)
+    }
+}
+
+func TestSanitizeLabels(t *testing.T) {
+    garbage := "FNS\xff\x01123"
+    if got := sanitizeLabel(garbage); got != "FNS~ 123" {
+        t.Errorf("sanitizeLabel(%q) = %q, expected %q", garbage, got, "FNS~ 123")
+    }
+    for _, stable := range([]bool{false, true}) {
+        e := newTestExporter(t)
+        e.SetStableLabels(stable)
+        ch := make(chan prometheus.Metric, 100)
+        MetricChan{ ch: ch, exporter: e }.Emit("eth0", errors.New("bad serial " + garbage), map[string]string{ "serial": garbage }, nil, nil)
+        close(ch)
+        var metrics constCollector
+        for metric := range(ch) {
+            metrics = append(metrics, metric)
+        }
+        if e.metricBuildErrors != 0 {
+            t.Errorf("stable labels %v: %d series were not built", stable, e.metricBuildErrors)
+        }
+        registry := prometheus.NewPedanticRegistry()
+        registry.MustRegister(metrics)
+        mfs, err := registry.Gather()
+        if err != nil {
+            t.Fatal(err)
+        }
+        errorSeen := false
+        for _, mf := range(mfs) {
+            for _, metric := range(mf.GetMetric()) {
+                for _, label := range(metric.GetLabel()) {
+                    if label.GetName() == "error" {
+                        errorSeen = true
+                        if label.GetValue() != "bad serial FNS~ 123" {
+                            t.Errorf("stable labels %v: %s has error label %q", stable, mf.GetName(), label.GetValue())
+                        }
+                    }
+                }
+            }
+        }
+        if !errorSeen {
+            t.Errorf("stable labels %v: no series has error label", stable)
+        }
+    }
+}
+
+// writeFixture creates files of sysfs fixture under root
+func writeFixture(t *testing.T, root string, files map[string]string) {
+    for name, content := range(files) {
+        path := filepath.Join(root, name)
+        if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+            t.Fatal(err)
+        }
+        if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+            t.Fatal(err)
+        }
+    }
+}
+
+func TestHwmonDiagDeviceTree(t *testing.T) {
+    root := t.TempDir()
+    defer func(net, hwmon string) { sysClassNet, sysClassHwmon = net, hwmon }(sysClassNet, sysClassHwmon)
+    sysClassNet, sysClassHwmon = filepath.Join(root, "net"), filepath.Join(root, "hwmon")
+    // mainline layout: MAC node refers to sfp node by phandle, sfp.c hwmon is under sfp platform device
+    writeFixture(t, root, map[string]string{
+        "net/eth0/device/of_node/sfp":           "\x00\x00\x00\x05",
+        "net/eth1/phydev/of_node/sfp":           "\x00\x00\x00\x06",
+        "net/eth2/device/of_node/compatible":    "marvell,armada-3700-neta",
+        "hwmon/hwmon0/name":                     "cpu_thermal\n",
+        "hwmon/hwmon0/device/of_node/phandle":   "\x00\x00\x00\x05",
+        "hwmon/hwmon0/temp1_input":             "60000\n",
+        "hwmon/hwmon1/name":                     "sfp_eth0\n",
+        "hwmon/hwmon1/device/of_node/phandle":   "\x00\x00\x00\x05",
+        "hwmon/hwmon1/temp1_input":             "35000\n",
+        "hwmon/hwmon1/power2_input":            "500\n",
+        "hwmon/hwmon2/name":                     "sfp_eth1\n",
+        "hwmon/hwmon2/device/of_node/phandle":   "\x00\x00\x00\x06",
+        "hwmon/hwmon2/temp1_input":             "40000\n",
+    })
+    tests := []struct {
+        iface  string
+        temp   float64
+        found  bool
+    }{
+        { "eth0", 35, true },  // sfp of MAC, not other hwmon with the same phandle
+        { "eth1", 40, true },  // sfp of PHY
+        { "eth2", 0,  false }, // no sfp
+    }
+    for _, test := range(tests) {
+        metrics, err := HwmonDiag(test.iface)
+        if (err == nil) != test.found {
+            t.Errorf("%s: error %v", test.iface, err)
+            continue
+        }
+        if err == nil && metrics.TemperatureC != test.temp {
+            t.Errorf("%s: temperature %v, expected %v", test.iface, metrics.TemperatureC, test.temp)
+        }
+    }
+    if metrics, _ := HwmonDiag("eth0"); metrics.Has(sff8472.DIAG_TX_POWER) || !metrics.Has(sff8472.DIAG_RX_POWER) {
+        t.Errorf("eth0: monitors missing %v, expected only rx power present", metrics.Missing)
+    }
+}
+
+func TestHwmonFallbackKeepsEepromError(t *testing.T) {
+    e := newTestExporter(t)
+    e.diagSource = DIAG_SOURCE_AUTO
+    ch := make(chan prometheus.Metric, 100)
+    tags := map[string]string{ "eeprom_error": "ethtool: Short read." }
+    MetricChan{ ch: ch, exporter: e }.Emit("eth0", nil, tags, &sff8472.TranscieverDiagnostics{ TemperatureC: 30 }, nil)
+    close(ch)
+    var eepromError, info bool
+    for metric := range(ch) {
+        switch metric.Desc() {
+            case e.descs.eepromError: eepromError = true
+            case e.descs.info:        info = true
+        }
+    }
+    if !eepromError || info {
+        t.Errorf("eeprom_error_info emitted %v, transciever_info emitted %v, expected only eeprom_error_info", eepromError, info)
+    }
+}
+
+func TestVanishedIface(t *testing.T) {
+    iface := "vanished0" // no such interface, ethtool ioctl fails with ENODEV
+    for _, report := range([]bool{false, true}) {
+        e := newTestExporter(t)
+        e.reportRemoved = report
+        record := e.collectIface(context.Background(), iface, map[string]int{ iface: 1 << 30 }, nil, nil)
+        if !report && record != nil {
+            t.Errorf("vanished interface was not skipped, error %v", record.err)
+        }
+        if report && (record == nil || record.err != sff8472.ErrInterfaceRemoved) {
+            t.Errorf("vanished interface was reported as %+v with -report-removed", record)
+        }
+    }
+}
+
+func TestSetNetns(t *testing.T) {
+    defer func() { sff8472.EthToolNetns = "" }()
+    tests := []struct {
+        source int
+        valid  bool
+    }{
+        { DIAG_SOURCE_ETHTOOL, true },
+        { DIAG_SOURCE_HWMON,   false },
+        { DIAG_SOURCE_AUTO,    false },
+    }
+    for _, test := range(tests) {
+        e := newTestExporter(t)
+        e.diagSource = test.source
+        if err := e.SetNetns("other"); (err == nil) != test.valid {
+            t.Errorf("diag source %d: SetNetns returned %v", test.source, err)
+        }
+        if e.netns != test.valid {
+            t.Errorf("diag source %d: netns %v after SetNetns", test.source, e.netns)
+        }
+    }
+    // sysfs of exporter's namespace is not read for interface of other namespace
+    e := newTestExporter(t)
+    if err := e.SetNetns("other"); err != nil {
+        t.Fatal(err)
+    }
+    e.collectLink = true
+    e.emptyCages = NewEmptyCages(time.Hour)
+    e.emptyCages.Put("lo", errors.New("no module"))
+    record := e.collectIface(context.Background(), "lo", nil, nil, nil)
+    if _, found := record.tags["alias"]; found || record.link.have_state {
+        t.Errorf("alias %q or link state (%v) read from sysfs with -netns", record.tags["alias"], record.link.have_state)
+    }
+}
+
+// emittedDescs returns how many times was each desc emitted by Emit
+func emittedDescs(e *Exporter, tags map[string]string, metrics *sff8472.TranscieverDiagnostics) map[*prometheus.Desc]int {
+    ch := make(chan prometheus.Metric, 200)
+    MetricChan{ ch: ch, exporter: e }.Emit("eth0", nil, tags, metrics, nil)
+    close(ch)
+    ret := make(map[*prometheus.Desc]int)
+    for metric := range(ch) {
+        ret[metric.Desc()]++
+    }
+    return ret
+}
+
+func TestPowerMarginZeroPower(t *testing.T) {
+    e := newTestExporter(t)
+    tags := map[string]string{ "rx_power_low_warn": "0.02", "tx_power_low_warn": "0.1" }
+    tests := []struct {
+        rx, tx float64 // mW
+        expect int     // series of each margin
+    }{
+        { 0.5, 0.5, 1 },
+        { 0,   0,   0 }, // dark receiver and disabled laser, margin would be -Inf
+    }
+    for _, test := range(tests) {
+        emitted := emittedDescs(e, tags, &sff8472.TranscieverDiagnostics{ ReceiveMW: test.rx, TransmitMW: test.tx })
+        if emitted[e.descs.rxMargin] != test.expect || emitted[e.descs.txMargin] != test.expect {
+            t.Errorf("rx %v mW, tx %v mW: %d rx and %d tx margins, expected %d", test.rx, test.tx,
+                emitted[e.descs.rxMargin], emitted[e.descs.txMargin], test.expect)
+        }
+    }
+}
+
+func TestLinkLossZeroPower(t *testing.T) {
+    e := newTestExporter(t)
+    reference := -2.0
+    e.linkTxReference = &reference
+    tests := []struct {
+        rx     float64 // mW
+        expect int
+    }{
+        { 0.1, 1 },
+        { 0,   0 }, // no light, loss would be +Inf
+    }
+    for _, test := range(tests) {
+        emitted := emittedDescs(e, map[string]string{}, &sff8472.TranscieverDiagnostics{ ReceiveMW: test.rx, TransmitMW: 0 })
+        if emitted[e.descs.loss] != test.expect {
+            t.Errorf("rx %v mW: %d loss series, expected %d", test.rx, emitted[e.descs.loss], test.expect)
+        }
+    }
+}
+
+func TestSighupResetsStatistics(t *testing.T) {
+    e := newTestExporter(t)
+    tags := map[string]string{ "serial": "FNS12345" }
+    e.tempHistory.Update("eth0", tags, 40)
+    e.firstSeen.Update("eth0", tags)
+    e.FlushOnSighup()
+    defer signal.Reset(syscall.SIGHUP)
+    if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+        t.Fatal(err)
+    }
+    for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+        _, history := e.tempHistory.Get("eth0", tags)
+        _, seen := e.firstSeen.Get("eth0", tags)
+        if !history && !seen {
+            return
+        }
+    }
+    t.Errorf("temperature history or first seen of serial kept after SIGHUP")
+}
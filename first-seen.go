@@ -0,0 +1,49 @@
+package main
+// vim: set et sw=4 :
+
+import (
+    "sync"
+    "time"
+)
+
+// FirstSeen remembers when each optic (by serial, see historyKey) was seen in its interface for the first time
+type FirstSeen struct {
+    mutex  sync.Mutex
+    times  map[string]time.Time
+    owners opticOwners
+}
+
+func NewFirstSeen() *FirstSeen {
+    return &FirstSeen{
+        times:  make(map[string]time.Time),
+        owners: newOpticOwners(),
+    }
+}
+
+func (f *FirstSeen) Update(iface string, tags map[string]string) {
+    key := historyKey(iface, tags)
+    f.mutex.Lock()
+    defer f.mutex.Unlock()
+    if old := f.owners.claim(iface, key); old != "" {
+        // optic was replaced, the new one is seen from now
+        delete(f.times, old)
+    }
+    if _, found := f.times[key]; !found {
+        f.times[key] = time.Now()
+    }
+}
+
+func (f *FirstSeen) Get(iface string, tags map[string]string) (time.Time, bool) {
+    f.mutex.Lock()
+    defer f.mutex.Unlock()
+    t, found := f.times[historyKey(iface, tags)]
+    return t, found
+}
+
+// Flush forgets all optics, each is seen for the first time on next scrape
+func (f *FirstSeen) Flush() {
+    f.mutex.Lock()
+    defer f.mutex.Unlock()
+    f.times = make(map[string]time.Time)
+    f.owners = newOpticOwners()
+}
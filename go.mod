@@ -1,10 +1,20 @@
 module github.com/ebikt/ethtool-exporter
 
-go 1.15
+go 1.17
 
 require (
 	github.com/mpvl/unique v0.0.0-20150818121801-cbe035fff7de
-	github.com/prometheus/client_golang v1.11.0
-	github.com/prometheus/common v0.31.1
-	golang.org/x/sys v0.0.0-20210923061019-b8560ed6a9b7
+	github.com/prometheus/client_golang v1.14.0
+	github.com/prometheus/common v0.37.0
+	golang.org/x/sys v0.0.0-20220520151302-bc2c85ada10a
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/client_model v0.3.0 // indirect
+	github.com/prometheus/procfs v0.8.0 // indirect
+	google.golang.org/protobuf v1.28.1 // indirect
 )
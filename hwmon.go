@@ -0,0 +1,122 @@
+package main
+// vim: set et sw=4 :
+
+import (
+    "bytes"
+    "fmt"
+    "io/ioutil"
+    "path/filepath"
+    "strconv"
+    "strings"
+
+    "github.com/ebikt/ethtool-exporter/sff8472"
+)
+
+const (
+    DIAG_SOURCE_ETHTOOL = iota
+    DIAG_SOURCE_HWMON
+    DIAG_SOURCE_AUTO
+)
+
+func ParseDiagSource(source string) (int, error) {
+    switch source {
+        case "ethtool": return DIAG_SOURCE_ETHTOOL, nil
+        case "hwmon":   return DIAG_SOURCE_HWMON, nil
+        case "auto":    return DIAG_SOURCE_AUTO, nil
+        default:
+            return 0, fmt.Errorf("Unknown diagnostics source '%s'", source)
+    }
+}
+
+// sysfs roots, tests point them to fixtures
+var (
+    sysClassNet   = "/sys/class/net"
+    sysClassHwmon = "/sys/class/hwmon"
+)
+
+// sfpLinks are paths relative to network device that lead to its SFP cage device (sfp.c), directly or through PHY.
+// Mainline kernels do not create them, but some vendor kernels do.
+var sfpLinks = []string{"sfp", filepath.Join("phydev", "sfp")}
+
+// sfpPhandleProps are device tree properties (relative to network device) referring to node of its SFP cage,
+// i.e. "sfp = <&sfp_eth3>" of MAC node or of PHY node of mainline device trees
+var sfpPhandleProps = []string{filepath.Join("device", "of_node", "sfp"), filepath.Join("phydev", "of_node", "sfp")}
+
+// findHwmon returns hwmon directory of the SFP cage of the network device. Hwmon registered under the network
+// device itself (i.e. by ixgbe, igb or mlx5) belongs to the NIC ASIC, not to the optic, so it is never used.
+func findHwmon(iface string) (string, error) {
+    for _, link := range(sfpLinks) {
+        sfp, err := filepath.EvalSymlinks(filepath.Join(sysClassNet, iface, link))
+        if err != nil { continue }
+        matches, _ := filepath.Glob(filepath.Join(sfp, "hwmon", "hwmon*"))
+        if len(matches) > 0 {
+            return matches[0], nil
+        }
+    }
+    for _, prop := range(sfpPhandleProps) {
+        phandle, err := ioutil.ReadFile(filepath.Join(sysClassNet, iface, prop))
+        if err != nil || len(phandle) != 4 { continue }
+        if dir := findSfpHwmon(phandle); dir != "" {
+            return dir, nil
+        }
+    }
+    return "", fmt.Errorf("hwmon: No SFP hwmon device for %s", iface)
+}
+
+// findSfpHwmon returns hwmon of sfp.c (named by its platform device, i.e. "sfp_eth3") whose device tree node
+// has given phandle, empty string when there is none
+func findSfpHwmon(phandle []byte) string {
+    matches, _ := filepath.Glob(filepath.Join(sysClassHwmon, "hwmon*"))
+    for _, dir := range(matches) {
+        name, err := ioutil.ReadFile(filepath.Join(dir, "name"))
+        if err != nil || !strings.HasPrefix(string(name), "sfp") { continue }
+        node, err := ioutil.ReadFile(filepath.Join(dir, "device", "of_node", "phandle"))
+        if err == nil && bytes.Equal(node, phandle) {
+            return dir
+        }
+    }
+    return ""
+}
+
+func readHwmonValue(dir string, name string) (float64, bool) {
+    data, err := ioutil.ReadFile(filepath.Join(dir, name))
+    if err != nil { return 0, false }
+    value, err := strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+    if err != nil { return 0, false }
+    return value, true
+}
+
+// HwmonDiag reads transciever diagnostics from hwmon sysfs interface.
+// Temperature is mandatory, the other monitors are filled only when driver provides them, see Missing.
+func HwmonDiag(iface string) (*sff8472.TranscieverDiagnostics, error) {
+    dir, err := findHwmon(iface)
+    if err != nil { return nil, err }
+    temp, ok := readHwmonValue(dir, "temp1_input") // millidegree Celsius
+    if !ok {
+        return nil, fmt.Errorf("hwmon: No temperature in %s", dir)
+    }
+    ret := &sff8472.TranscieverDiagnostics{ TemperatureC: temp * 0.001 }
+    if volt, ok := readHwmonValue(dir, "in0_input"); ok { // millivolt
+        ret.VoltageV = volt * 0.001
+    } else {
+        ret.Missing |= sff8472.DIAG_VOLTAGE
+    }
+    if bias, ok := readHwmonValue(dir, "curr1_input"); ok { // milliampere
+        ret.BiasMA = bias
+    } else {
+        ret.Missing |= sff8472.DIAG_BIAS
+    }
+    if tx, ok := readHwmonValue(dir, "power1_input"); ok { // microwatt
+        ret.TransmitMW = tx * 0.001
+    } else {
+        ret.Missing |= sff8472.DIAG_TX_POWER
+    }
+    if rx, ok := readHwmonValue(dir, "power2_input"); ok { // microwatt
+        ret.ReceiveMW = rx * 0.001
+    } else {
+        ret.Missing |= sff8472.DIAG_RX_POWER
+    }
+    ret.TransmitDBm = sff8472.PowerDecibels(ret.TransmitMW, 1)
+    ret.ReceiveDBm  = sff8472.PowerDecibels(ret.ReceiveMW, 1)
+    return ret, nil
+}
@@ -0,0 +1,87 @@
+package main
+// vim: set et sw=4 :
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "net/url"
+    "os"
+    "time"
+)
+
+const (
+    influxPushRetries = 3
+    influxPushTimeout = 10 * time.Second
+)
+
+// InfluxPusher posts line protocol of every background scrape to InfluxDB write endpoint
+type InfluxPusher struct {
+    url    string
+    token  string
+    client *http.Client
+}
+
+// NewInfluxPusher adds database (InfluxDB 1.x) or org and bucket (InfluxDB 2.x) and timestamp precision
+// query parameters to write url, token is sent in Authorization header when not empty
+func NewInfluxPusher(writeUrl, database, org, bucket, token, precision string) (*InfluxPusher, error) {
+    u, err := url.Parse(writeUrl)
+    if err != nil { return nil, err }
+    if u.Scheme != "http" && u.Scheme != "https" {
+        return nil, fmt.Errorf("Invalid influx push url '%s'", writeUrl)
+    }
+    query := u.Query()
+    for name, value := range(map[string]string{"db": database, "org": org, "bucket": bucket, "precision": precision}) {
+        if value != "" {
+            query.Set(name, value)
+        }
+    }
+    u.RawQuery = query.Encode()
+    return &InfluxPusher{
+        url:    u.String(),
+        token:  token,
+        client: &http.Client{ Timeout: influxPushTimeout },
+    }, nil
+}
+
+// Push formats current snapshot of exporter and posts it, failed attempts are retried with increasing delay
+func (p *InfluxPusher) Push(e *Exporter) {
+    var batch bytes.Buffer
+    if err := e.Influxdb(context.Background(), &batch); err != nil {
+        fmt.Fprintf(os.Stderr, "Error: influx push: %v\n", err)
+        return
+    }
+    delay := time.Second
+    for attempt := 1; ; attempt++ {
+        err := p.post(batch.Bytes())
+        if err == nil {
+            return
+        }
+        if attempt >= influxPushRetries {
+            fmt.Fprintf(os.Stderr, "Error: influx push: %v\n", err)
+            return
+        }
+        time.Sleep(delay)
+        delay *= 2
+    }
+}
+
+func (p *InfluxPusher) post(batch []byte) error {
+    req, err := http.NewRequest("POST", p.url, bytes.NewReader(batch))
+    if err != nil { return err }
+    req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+    if p.token != "" {
+        req.Header.Set("Authorization", "Token " + p.token)
+    }
+    resp, err := p.client.Do(req)
+    if err != nil { return err }
+    defer resp.Body.Close()
+    body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+    if resp.StatusCode / 100 != 2 {
+        return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+    }
+    return nil
+}
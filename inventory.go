@@ -0,0 +1,67 @@
+package main
+// vim: set et sw=4 :
+
+import (
+    "bufio"
+    "fmt"
+    "os"
+    "strings"
+    "sync"
+)
+
+// Inventory holds expected serial of optic per interface (-inventory-file), to catch optics swapped by mistake
+type Inventory struct {
+    path    string
+    mutex   sync.Mutex
+    serials map[string]string
+}
+
+// NewInventory loads inventory file, see Reload
+func NewInventory(path string) (*Inventory, error) {
+    inv := &Inventory{ path: path }
+    if err := inv.Reload(); err != nil {
+        return nil, err
+    }
+    return inv, nil
+}
+
+// Reload reads inventory file again. Every line is "iface serial", empty lines and lines starting with # are skipped.
+// On error the previous inventory is kept.
+func (inv *Inventory) Reload() error {
+    file, err := os.Open(inv.path)
+    if err != nil { return err }
+    defer file.Close()
+    serials := make(map[string]string)
+    scanner := bufio.NewScanner(file)
+    for lineno := 1; scanner.Scan(); lineno++ {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        fields := strings.Fields(line)
+        if len(fields) != 2 {
+            return fmt.Errorf("%s:%d: expected \"iface serial\"", inv.path, lineno)
+        }
+        if _, found := serials[fields[0]]; found {
+            return fmt.Errorf("%s:%d: duplicate interface %s", inv.path, lineno, fields[0])
+        }
+        serials[fields[0]] = fields[1]
+    }
+    if err := scanner.Err(); err != nil { return err }
+    inv.mutex.Lock()
+    defer inv.mutex.Unlock()
+    inv.serials = serials
+    return nil
+}
+
+// Match returns 1 when serial is expected in interface, 0 when other (or no) optic is seated
+// and -1 when interface is not in inventory
+func (inv *Inventory) Match(iface, serial string) float64 {
+    inv.mutex.Lock()
+    defer inv.mutex.Unlock()
+    expected, found := inv.serials[iface]
+    if !found {
+        return -1
+    }
+    return boolGauge(serial == expected)
+}
@@ -0,0 +1,120 @@
+package main
+// vim: set et sw=4 :
+
+import (
+    "compress/gzip"
+    "context"
+    "encoding/json"
+    "math"
+    "net/http"
+    "time"
+
+    "github.com/ebikt/ethtool-exporter/sff8472"
+)
+
+// JSONChan emits influx-style points encoded as JSON objects, one per interface
+type JSONChan struct {
+    ch    chan<- []byte
+    done  <-chan struct{}
+    time  int64
+    power powerUnit
+}
+
+type jsonPoint struct {
+    Measurement string                 `json:"measurement"`
+    Tags        map[string]string      `json:"tags"`
+    Fields      map[string]interface{} `json:"fields"`
+    Time        int64                  `json:"time"`
+}
+
+// jsonFloat returns nil for values that cannot be encoded in JSON (i.e. -Inf dBm of dark receiver)
+func jsonFloat(value float64) interface{} {
+    if math.IsInf(value, 0) || math.IsNaN(value) {
+        return nil
+    }
+    return value
+}
+
+func (jc JSONChan) Emit(iface string, err error, tags map[string]string, metrics *sff8472.TranscieverDiagnostics, link *LinkInfo) {
+    point := jsonPoint{
+        Measurement: namespace + "_transciever",
+        Tags:        make(map[string]string),
+        Fields:      map[string]interface{}{ "present": 0 },
+        Time:        jc.time,
+    }
+    for _, label := range(append([]string{"iface", "error"}, transcieverTags()...)) {
+        var value string
+        switch label {
+            case "iface": value = iface
+            case "error": if (err != nil) { value = err.Error() }
+            default: value = tags[label]
+        }
+        if len(value) > 0 {
+            point.Tags[label] = value
+        }
+    }
+    if err == nil {
+        point.Fields["present"] = 1
+    }
+    if err == nil && metrics != nil {
+        point.Fields["temperature_C"]      = jsonFloat(metrics.TemperatureC)
+        if metrics.Has(sff8472.DIAG_VOLTAGE) {
+            point.Fields["voltage_V"]      = jsonFloat(metrics.VoltageV)
+        }
+        if metrics.Has(sff8472.DIAG_BIAS) {
+            point.Fields["bias_A"]         = jsonFloat(metrics.BiasMA * 0.001)
+        }
+        if metrics.Has(sff8472.DIAG_RX_POWER) {
+            point.Fields["receive_power_"  + jc.power.field] = jsonFloat(jc.power.Field(metrics.ReceiveMW))
+            point.Fields["receive_power_W"]  = jsonFloat(metrics.ReceiveMW * 0.001)
+        }
+        if metrics.Has(sff8472.DIAG_TX_POWER) {
+            point.Fields["transmit_power_" + jc.power.field] = jsonFloat(jc.power.Field(metrics.TransmitMW))
+            point.Fields["transmit_power_W"] = jsonFloat(metrics.TransmitMW * 0.001)
+        }
+    }
+    line, jerr := json.Marshal(point)
+    if jerr != nil {
+        // cannot happen, all values are plain strings and finite numbers
+        panic(jerr)
+    }
+    select {
+        case jc.ch <- line:
+        case <-jc.done:
+    }
+}
+
+// JSONLinesHandler streams one JSON object per interface, flushing after each of them
+func (e *Exporter) JSONLinesHandler() (func(http.ResponseWriter, *http.Request)) {
+    return func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/x-ndjson")
+        writer, closer := compressedWriter(w, r)
+        defer closer()
+        flusher, _ := w.(http.Flusher)
+        ctx, cancel := context.WithCancel(r.Context())
+        defer cancel()
+
+        lines := make(chan []byte)
+        go func () {
+            defer close(lines)
+            e.CollectTo(ctx, JSONChan{ ch: lines, done: ctx.Done(), time: time.Now().UnixNano(), power: e.powerUnit })
+        } ()
+
+        for line := range(lines) {
+            if ctx.Err() != nil {
+                // client is gone, just drain the channel until collection stops
+                continue
+            }
+            if _, err := writer.Write(append(line, '\n')); err != nil {
+                cancel()
+                continue
+            }
+            if gz, ok := writer.(*gzip.Writer); ok {
+                gz.Flush()
+            }
+            if flusher != nil {
+                flusher.Flush()
+            }
+        }
+    }
+}
@@ -0,0 +1,91 @@
+package main
+// vim: set et sw=4 :
+
+import (
+    "io/ioutil"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "unsafe"
+    "golang.org/x/sys/unix"
+    "github.com/ebikt/ethtool-exporter/sff8472"
+)
+
+// LinkInfo describes state of network interface itself (not of its transciever)
+type LinkInfo struct {
+    have_settings bool // following fields are valid
+    speed_Mbps    uint32
+    have_duplex   bool
+    full_duplex   bool
+    have_state    bool // following fields are valid
+    link_up       bool // operstate is up
+    admin_up      bool // IFF_UP flag is set
+}
+
+const (
+    ethtool_SPEED_UNKNOWN  = 0xffffffff
+    ethtool_DUPLEX_HALF    = 0x00
+    ethtool_DUPLEX_FULL    = 0x01
+    ethtool_LINK_MODE_MASK_MAX_NWORDS = 127
+)
+
+type ethtoolLinkSettings struct {
+    cmd                    uint32
+    speed                  uint32
+    duplex                 uint8
+    port                   uint8
+    phy_address            uint8
+    autoneg                uint8
+    mdio_support           uint8
+    eth_tp_mdix            uint8
+    eth_tp_mdix_ctrl       uint8
+    link_mode_masks_nwords int8
+    transceiver            uint8
+    master_slave_cfg       uint8
+    master_slave_state     uint8
+    reserved1              [1]uint8
+    reserved               [7]uint32
+    link_mode_masks        [3 * ethtool_LINK_MODE_MASK_MAX_NWORDS]uint32
+}
+
+// GetLinkSettings reads negotiated speed and duplex using ETHTOOL_GLINKSETTINGS
+func GetLinkSettings(ifname string) (*LinkInfo, error) {
+    var name [unix.IFNAMSIZ]byte
+    copy(name[:], []byte(ifname))
+    // Handshake: kernel responds with negative number of words of link mode masks it uses
+    settings := ethtoolLinkSettings{ cmd: unix.ETHTOOL_GLINKSETTINGS }
+    err := sff8472.EthTool(name, uintptr(unsafe.Pointer(&settings)))
+    if err != nil { return nil, err }
+    if settings.link_mode_masks_nwords >= 0 {
+        return nil, unix.EOPNOTSUPP
+    }
+    settings = ethtoolLinkSettings{
+        cmd:                    unix.ETHTOOL_GLINKSETTINGS,
+        link_mode_masks_nwords: -settings.link_mode_masks_nwords,
+    }
+    err = sff8472.EthTool(name, uintptr(unsafe.Pointer(&settings)))
+    if err != nil { return nil, err }
+    ret := &LinkInfo{}
+    if settings.speed != ethtool_SPEED_UNKNOWN {
+        ret.have_settings = true
+        ret.speed_Mbps = settings.speed
+    }
+    if settings.duplex == ethtool_DUPLEX_HALF || settings.duplex == ethtool_DUPLEX_FULL {
+        ret.have_duplex = true
+        ret.full_duplex = settings.duplex == ethtool_DUPLEX_FULL
+    }
+    return ret, nil
+}
+
+// ReadLinkState fills operational and administrative state of interface from sysfs
+func ReadLinkState(iface string, link *LinkInfo) {
+    operstate, err := ioutil.ReadFile(filepath.Join(sysClassNet, iface, "operstate"))
+    if err != nil { return }
+    flags, err := ioutil.ReadFile(filepath.Join(sysClassNet, iface, "flags"))
+    if err != nil { return }
+    value, err := strconv.ParseUint(strings.TrimSpace(string(flags)), 0, 32)
+    if err != nil { return }
+    link.have_state = true
+    link.link_up = strings.TrimSpace(string(operstate)) == "up"
+    link.admin_up = value & unix.IFF_UP != 0
+}
@@ -0,0 +1,104 @@
+package main
+// vim: set et sw=4 :
+
+import (
+    "context"
+    "fmt"
+    "net/http"
+    "net/url"
+    "time"
+
+    "github.com/ebikt/ethtool-exporter/sff8472"
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// ifaceFilter matches interfaces by iface name or tags, i.e. "?iface=enp1s0f0&vendor=FS".
+// Values of the same key are alternatives, all keys must match.
+type ifaceFilter map[string][]string
+
+// parseIfaceFilter accepts iface and tag names of transciever_present, transciever_info and influx output
+func parseIfaceFilter(query url.Values) (ifaceFilter, error) {
+    known := map[string]bool{ "iface": true }
+    for _, label := range(transcieverTags()) {
+        known[label] = true
+    }
+    for _, label := range(transcieverInfoLabels) {
+        known[label] = true
+    }
+    for key := range(query) {
+        if !known[key] {
+            return nil, fmt.Errorf("Unknown filter '%s'", key)
+        }
+    }
+    return ifaceFilter(query), nil
+}
+
+func (f ifaceFilter) Match(iface string, tags map[string]string) bool {
+    for key, values := range(f) {
+        value := tags[key]
+        if key == "iface" {
+            value = iface
+        }
+        matched := false
+        for _, v := range(values) {
+            matched = matched || v == value
+        }
+        if !matched {
+            return false
+        }
+    }
+    return true
+}
+
+// filteringEmiter passes only interfaces matching filter
+type filteringEmiter struct {
+    ch     Emiter
+    filter ifaceFilter
+}
+
+func (fe filteringEmiter) Emit(iface string, err error, tags map[string]string, metrics *sff8472.TranscieverDiagnostics, link *LinkInfo) {
+    if fe.filter.Match(iface, tags) {
+        fe.ch.Emit(iface, err, tags, metrics, link)
+    }
+}
+
+func (fe filteringEmiter) At(t time.Time) Emiter {
+    if tch, ok := fe.ch.(timestampedEmiter); ok {
+        fe.ch = tch.At(t)
+    }
+    return fe
+}
+
+// filteredCollector exports only per interface metrics of matching interfaces, exporter-wide
+// metrics are omitted. It is unchecked, as it is registered only to temporary registry.
+type filteredCollector struct {
+    exporter *Exporter
+    filter   ifaceFilter
+}
+
+func (fc filteredCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (fc filteredCollector) Collect(ch chan<- prometheus.Metric) {
+    fc.exporter.CollectTo(context.Background(), filteringEmiter{ MetricChan{ ch: ch, exporter: fc.exporter }, fc.filter })
+}
+
+// MetricsHandler serves default registry, or only matching interfaces when query has filters
+func (e *Exporter) MetricsHandler() http.Handler {
+    all := promhttp.Handler()
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        query := r.URL.Query()
+        if len(query) == 0 {
+            all.ServeHTTP(w, r)
+            return
+        }
+        filter, err := parseIfaceFilter(query)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        registry := prometheus.NewRegistry()
+        registry.MustRegister(filteredCollector{ e, filter })
+        promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+    })
+}
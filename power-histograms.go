@@ -0,0 +1,63 @@
+package main
+// vim: set et sw=4 :
+
+import (
+    "math"
+
+    "github.com/ebikt/ethtool-exporter/sff8472"
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// powerBuckets_dBm cover usual range of optical power, from dark receiver to long range laser.
+// They are exported for scrapers without native histograms support.
+var powerBuckets_dBm = prometheus.LinearBuckets(-30, 2, 19)
+
+const (
+    powerNativeBucketFactor = 1.1 // each native bucket at most 10% wider than previous one
+    powerNativeMaxBuckets   = 100 // garbage reads must not grow native histogram without limit
+)
+
+// PowerHistograms accumulate optical power of every collection per interface (-power-histograms)
+// into native histograms, that Prometheus 2.40+ with native histograms enabled scrapes over protobuf.
+type PowerHistograms struct {
+    rx *prometheus.HistogramVec
+    tx *prometheus.HistogramVec
+}
+
+// NewPowerHistograms creates histograms with interface in label ifaceLabel (iface, unless renamed by -relabel)
+func NewPowerHistograms(ifaceLabel string) *PowerHistograms {
+    newVec := func(name, help string) *prometheus.HistogramVec {
+        return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+            Namespace: namespace,
+            Name:      name,
+            Help:      help,
+            Buckets:   powerBuckets_dBm,
+            NativeHistogramBucketFactor:    powerNativeBucketFactor,
+            NativeHistogramMaxBucketNumber: powerNativeMaxBuckets,
+        }, []string{ifaceLabel})
+    }
+    return &PowerHistograms{
+        rx: newVec("transciever_rx_power_dbm", "Distribution of receiver signal average optical power (dBm) over scrapes"),
+        tx: newVec("transciever_tx_power_dbm", "Distribution of laser output power (dBm) over scrapes"),
+    }
+}
+
+// Observe adds power of one collection, dark receiver (-Inf dBm) and missing monitors are not counted
+func (h *PowerHistograms) Observe(iface string, metrics *sff8472.TranscieverDiagnostics) {
+    if metrics.Has(sff8472.DIAG_RX_POWER) && !math.IsInf(metrics.ReceiveDBm, 0) && !math.IsNaN(metrics.ReceiveDBm) {
+        h.rx.WithLabelValues(iface).Observe(metrics.ReceiveDBm)
+    }
+    if metrics.Has(sff8472.DIAG_TX_POWER) && !math.IsInf(metrics.TransmitDBm, 0) && !math.IsNaN(metrics.TransmitDBm) {
+        h.tx.WithLabelValues(iface).Observe(metrics.TransmitDBm)
+    }
+}
+
+func (h *PowerHistograms) Describe(ch chan<- *prometheus.Desc) {
+    h.rx.Describe(ch)
+    h.tx.Describe(ch)
+}
+
+func (h *PowerHistograms) Collect(ch chan<- prometheus.Metric) {
+    h.rx.Collect(ch)
+    h.tx.Collect(ch)
+}
@@ -0,0 +1,89 @@
+package main
+// vim: set et sw=4 :
+
+import (
+    "fmt"
+    "math"
+    "sync"
+
+    "github.com/ebikt/ethtool-exporter/sff8472"
+)
+
+// sampleRotation selects interfaces collected in this scrape with -sample-fraction, round-robin
+type sampleRotation struct {
+    fraction float64
+    next     int
+    mutex    sync.Mutex
+    cache    *Snapshot // last result of every collected interface, replayed for the others
+}
+
+// SetSampleFraction makes every scrape collect only given fraction of interfaces, the others are replayed
+// from their last collection. Fraction 1 collects all interfaces.
+func (e *Exporter) SetSampleFraction(fraction float64) {
+    if fraction <= 0 || fraction > 1 {
+        panic(fmt.Errorf("Invalid -sample-fraction %v, expected 0 < fraction <= 1", fraction))
+    }
+    e.sampling = nil
+    if fraction < 1 {
+        e.sampling = &sampleRotation{ fraction: fraction, cache: NewSnapshot() }
+    }
+}
+
+// split returns interfaces to collect now, that is next ones in rotation and those never collected yet,
+// and interfaces to replay from cache
+func (s *sampleRotation) split(ifaces []string) ([]string, []string) {
+    if len(ifaces) == 0 {
+        return ifaces, nil
+    }
+    s.mutex.Lock()
+    n := int(math.Ceil(s.fraction * float64(len(ifaces))))
+    start := s.next % len(ifaces)
+    s.next = (start + n) % len(ifaces)
+    s.mutex.Unlock()
+
+    selected := make(map[string]bool)
+    for i := 0; i < n; i++ {
+        selected[ifaces[(start + i) % len(ifaces)]] = true
+    }
+    var collect, replay []string
+    for _, iface := range(ifaces) {
+        if _, found := s.cache.Get(iface); selected[iface] || !found {
+            collect = append(collect, iface)
+        } else {
+            replay = append(replay, iface)
+        }
+    }
+    return collect, replay
+}
+
+// replay emits cached results of ifaces with tag sampled=0
+func (s *sampleRotation) replay(ch Emiter, ifaces []string) {
+    for _, iface := range(ifaces) {
+        if record, found := s.cache.Get(iface); found {
+            ch.Emit(iface, record.err, sampledTags(record.tags, "0"), record.metrics, record.link)
+        }
+    }
+}
+
+// sampledTags returns copy of tags with "sampled" tag, cached tags are shared between scrapes
+func sampledTags(tags map[string]string, sampled string) map[string]string {
+    ret := make(map[string]string, len(tags) + 1)
+    for k, v := range(tags) {
+        ret[k] = v
+    }
+    ret["sampled"] = sampled
+    return ret
+}
+
+// sampleEmiter remembers collected interfaces for next scrapes and marks them with tag sampled=1
+type sampleEmiter struct {
+    ch    Emiter
+    cache *Snapshot
+}
+
+func (se sampleEmiter) Emit(iface string, err error, tags map[string]string, metrics *sff8472.TranscieverDiagnostics, link *LinkInfo) {
+    if err != ErrDeadlineExceeded {
+        se.cache.Emit(iface, err, tags, metrics, link)
+    }
+    se.ch.Emit(iface, err, sampledTags(tags, "1"), metrics, link)
+}
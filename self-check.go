@@ -0,0 +1,103 @@
+package main
+// vim: set et sw=4 :
+
+import (
+    "bufio"
+    "bytes"
+    "fmt"
+    "io"
+    "math"
+    "os/exec"
+    "regexp"
+    "strconv"
+    "strings"
+
+    "github.com/ebikt/ethtool-exporter/sff8472"
+)
+
+// selfCheckFields map "ethtool -m" keys to our tags, compared as strings
+var selfCheckFields = map[string]string{
+    "Vendor name": "vendor",
+    "Vendor PN":   "product",
+    "Vendor SN":   "serial",
+}
+
+// selfCheckNumber extracts the first number of "ethtool -m" value, i.e. 41.50 of "41.50 degrees C / 106.70 degrees F"
+var selfCheckNumber = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?`)
+
+// selfCheckMonitor compares monitor value of "ethtool -m" with our decoded one within tolerance
+type selfCheckMonitor struct {
+    key       string
+    value     func(*sff8472.TranscieverDiagnostics) float64
+    tolerance float64
+}
+
+var selfCheckMonitors = []selfCheckMonitor{
+    { "Module temperature", func(d *sff8472.TranscieverDiagnostics) float64 { return d.TemperatureC }, 0.5 },
+    { "Module voltage", func(d *sff8472.TranscieverDiagnostics) float64 { return d.VoltageV }, 0.01 },
+    { "Laser bias current", func(d *sff8472.TranscieverDiagnostics) float64 { return d.BiasMA }, 0.1 },
+    { "Laser output power", func(d *sff8472.TranscieverDiagnostics) float64 { return d.TransmitMW }, 0.01 },
+    { "Receiver signal average optical power", func(d *sff8472.TranscieverDiagnostics) float64 { return d.ReceiveMW }, 0.01 },
+}
+
+// parseEthtoolModule parses "key : value" lines of "ethtool -m", first occurrence of each key wins
+func parseEthtoolModule(output []byte) map[string]string {
+    ret := make(map[string]string)
+    scanner := bufio.NewScanner(bytes.NewReader(output))
+    for scanner.Scan() {
+        colon := strings.Index(scanner.Text(), ":")
+        if colon < 0 {
+            continue
+        }
+        key := strings.TrimSpace(scanner.Text()[:colon])
+        if _, found := ret[key]; !found {
+            ret[key] = strings.TrimSpace(scanner.Text()[colon+1:])
+        }
+    }
+    return ret
+}
+
+// SelfCheck compares our decoding of interface with "ethtool -m" output, it returns number of mismatches.
+// Monitors may change between both reads, so they are compared with tolerance.
+func SelfCheck(writer io.Writer, iface string) (int, error) {
+    m, err := sff8472.NewEthToolModule(iface)
+    if err != nil { return 0, err }
+    tags, err := m.ModuleInfo(sff8472.TXR_MI_ALL)
+    if err != nil { return 0, err }
+    metrics, err := m.TxrDiag()
+    if err != nil { return 0, err }
+
+    output, err := exec.Command("ethtool", "-m", iface).Output()
+    if err != nil { return 0, fmt.Errorf("ethtool -m %s: %v", iface, err) }
+    theirs := parseEthtoolModule(output)
+
+    mismatches := 0
+    for key, tag := range(selfCheckFields) {
+        value, found := theirs[key]
+        if !found {
+            continue
+        }
+        if value != tags[tag] {
+            fmt.Fprintf(writer, "%s: %s: ethtool '%s', decoded '%s'\n", iface, tag, value, tags[tag])
+            mismatches++
+        }
+    }
+    if metrics == nil {
+        return mismatches, nil
+    }
+    for _, monitor := range(selfCheckMonitors) {
+        value, found := theirs[monitor.key]
+        if !found {
+            continue
+        }
+        expected, err := strconv.ParseFloat(selfCheckNumber.FindString(value), 64)
+        if err != nil {
+            continue
+        }
+        if decoded := monitor.value(metrics); math.Abs(decoded - expected) > monitor.tolerance {
+            fmt.Fprintf(writer, "%s: %s: ethtool %v, decoded %v\n", iface, monitor.key, expected, decoded)
+            mismatches++
+        }
+    }
+    return mismatches, nil
+}
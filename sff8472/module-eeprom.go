@@ -0,0 +1,1686 @@
+// Package sff8472 reads and decodes EEPROM of SFP (SFF-8472), QSFP (SFF-8636) and CMIS
+// transcievers using ethtool ioctls.
+package sff8472
+// vim: set et sw=4 :
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/hex"
+    "errors"
+    "math"
+    "regexp"
+    "runtime"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+    "unsafe"
+    "golang.org/x/sys/unix"
+)
+
+const (
+    TXR_MI_ALL         = 0x3FFF
+    TXR_MI_CACHE       = 1 << 14 // fields selected by SetCacheFields are cached by serial number
+    TXR_MI_ALLOW_CACHE = TXR_MI_ALL | TXR_MI_CACHE
+
+    TXR_MI_VENDOR   = 1 << 0
+    TXR_MI_OUI      = 1 << 1
+    TXR_MI_PRODUCT  = 1 << 2
+    TXR_MI_REVISION = 1 << 3
+    TXR_MI_WAVELEN  = 1 << 4
+    TXR_MI_SERIAL   = 1 << 5
+    TXR_MI_DATE     = 1 << 6
+    TXR_MI_OPTIONS  = 1 << 7
+    TXR_MI_CUSTOM   = 1 << 8 // user supplied fields, see AddEepromField
+    TXR_MI_THRESHOLDS = 1 << 9
+    TXR_MI_DDM      = 1 << 10
+    TXR_MI_COMPLIANCE = 1 << 11
+)
+
+type EthToolModule struct {
+    ifname     [unix.IFNAMSIZ]byte
+    tpe        uint32
+    eeprom_len uint32
+    cmis       bool
+    Throttle   *ReadThrottle // optional, spaces EEPROM reads
+    Context    context.Context // optional, once it is done reads fail with its error and nothing is cached
+    Debug      bool // print read plan of readTable
+    ddmUnavailable string // reason why TxrDiag returned no diagnostics
+    reader     func(offset uint32, len uint32) ([]byte, error) // replaces ioctl of Read in tests
+    driverTpe  uint32 // type and EEPROM length reported by driver (or ModuleTypeOverrides),
+    driverLen  uint32 // tpe and eeprom_len are derived from them by identifier
+    overriden  bool
+    identified bool   // identifier was applied, see identify
+    idCached   bool   // identifier was taken from identifierCache and not yet checked by serial
+    identifier int    // SFF-8024 identifier (byte 0), -1 when it could not be read
+    idSerial   string // serial of identifierCache entry
+    idErr      error
+}
+
+// ReadThrottle spaces consecutive EEPROM reads (e.g. of ports sharing one I2C bus)
+// by at least interval. It is shared by serial group.
+type ReadThrottle struct {
+    mutex    sync.Mutex
+    interval time.Duration
+    last     time.Time
+}
+
+func NewReadThrottle(interval time.Duration) *ReadThrottle {
+    return &ReadThrottle{ interval: interval }
+}
+
+func (t *ReadThrottle) Wait() {
+    if t == nil || t.interval <= 0 {
+        return
+    }
+    t.mutex.Lock()
+    defer t.mutex.Unlock()
+    if wait := time.Until(t.last.Add(t.interval)); wait > 0 {
+        time.Sleep(wait)
+    }
+    t.last = time.Now()
+}
+
+type TranscieverDiagnostics struct {
+    TemperatureC float64
+    VoltageV     float64
+    BiasMA       float64
+    TransmitMW   float64
+    ReceiveMW    float64
+    TransmitDBm  float64
+    ReceiveDBm   float64
+    HaveStatus   bool // following fields are valid
+    TxDisable    bool
+    TxFault      bool
+    RxLos        bool
+    DataReady    bool
+    Line         *TranscieverDiagnostics // line side monitors of optics with retimer, see LineSideDiag
+    Aux          []AuxMonitor // only with AuxMonitorsEnabled
+    Missing      int // DIAG_* monitors not provided by source (i.e. hwmon), their values are 0
+}
+
+// Monitors of TranscieverDiagnostics.Missing, temperature is always present
+const (
+    DIAG_VOLTAGE = 1 << iota
+    DIAG_BIAS
+    DIAG_TX_POWER
+    DIAG_RX_POWER
+)
+
+// Has tells whether monitor (DIAG_*) was read
+func (d *TranscieverDiagnostics) Has(monitor int) bool {
+    return d.Missing & monitor == 0
+}
+
+// AuxMonitor is value of auxiliary monitor (A2h bytes 106-109)
+type AuxMonitor struct {
+    Type  string  // see auxMonitorTypes, includes unit
+    Value float64 // in volts, amperes or degrees Celsius
+}
+
+// AuxMonitorsEnabled makes TxrDiag decode AUX1 and AUX2 monitors, whose types are in nibbles of A0h byte 98.
+// That byte is in vendor specific area, so enable it only for optics known to use it.
+var AuxMonitorsEnabled bool
+
+type auxMonitorType struct {
+    name   string
+    signed bool
+    mult   float64
+}
+
+// auxMonitorTypes are AUX monitor type codes with their scaling (the same codes as XFP, INF-8077i table 41)
+var auxMonitorTypes = map[byte]auxMonitorType{
+    0x1: { "apd_bias_volts",           false, 0.01 },
+    0x3: { "tec_current_amperes",      true,  0.0001 },
+    0x4: { "laser_temperature_celsius", true, 1.0 / 256 },
+    0x6: { "supply_5v_volts",          false, 0.0001 },
+    0x7: { "supply_3v3_volts",         false, 0.0001 },
+    0x8: { "supply_1v8_volts",         false, 0.0001 },
+    0x9: { "supply_minus_5v2_volts",   false, 0.0001 },
+    0xa: { "supply_5v_amperes",        false, 0.0001 },
+    0xd: { "supply_3v3_amperes",       false, 0.0001 },
+    0xe: { "supply_1v8_amperes",       false, 0.0001 },
+    0xf: { "supply_minus_5v2_amperes", false, 0.0001 },
+}
+
+// decodeAux decodes AUX1 (high nibble of types) and AUX2 (low nibble) from 4 bytes at A2h byte 106.
+// Not implemented (0), reserved and laser wavelength types are skipped.
+func decodeAux(types byte, data []byte) []AuxMonitor {
+    var ret []AuxMonitor
+    for i, code := range([]byte{types >> 4, types & 0x0f}) {
+        tpe, found := auxMonitorTypes[code]
+        if !found {
+            continue
+        }
+        raw := binary.BigEndian.Uint16(data[i*2:i*2+2])
+        value := float64(raw)
+        if tpe.signed {
+            value = float64(int16(raw))
+        }
+        ret = append(ret, AuxMonitor{ Type: tpe.name, Value: value * tpe.mult })
+    }
+    return ret
+}
+
+var ethtool_socket int = -1
+
+// ethtoolSocketMutex is held for reading during ioctl, so that socket is not closed under other goroutines
+var ethtoolSocketMutex sync.RWMutex
+
+// EthToolSocketResets counts sockets closed and reopened after EBADF or ENOTCONN, read atomically
+var EthToolSocketResets uint64
+
+func CloseEthToolSocket() {
+    ethtoolSocketMutex.Lock()
+    defer ethtoolSocketMutex.Unlock()
+    if ethtool_socket >= 0 {
+        unix.Close(ethtool_socket)
+        ethtool_socket = -1
+    }
+}
+
+// resetEthToolSocket closes socket that failed, unless other goroutine already replaced it
+func resetEthToolSocket(fd int) {
+    ethtoolSocketMutex.Lock()
+    defer ethtoolSocketMutex.Unlock()
+    if fd >= 0 && ethtool_socket == fd {
+        unix.Close(ethtool_socket)
+        ethtool_socket = -1
+        atomic.AddUint64(&EthToolSocketResets, 1)
+    }
+}
+
+type ifreq struct {
+    ifr_name [unix.IFNAMSIZ]byte
+    ifr_data uintptr
+}
+
+// EthToolNetns is network namespace (name in /var/run/netns or path) where ethtool socket is opened
+var EthToolNetns string
+
+// socketInNetns opens socket in given network namespace. Socket stays bound
+// to that namespace, so the thread can return to original namespace right away.
+// Requires CAP_SYS_ADMIN.
+func socketInNetns(netns string, domain, typ, proto int) (int, error) {
+    path := netns
+    if !strings.Contains(netns, "/") {
+        path = "/var/run/netns/" + netns
+    }
+    target, err := unix.Open(path, unix.O_RDONLY | unix.O_CLOEXEC, 0)
+    if err != nil { return -1, fmt.Errorf("netns %s: %v", path, err) }
+    defer unix.Close(target)
+
+    runtime.LockOSThread()
+    defer runtime.UnlockOSThread()
+    orig, err := unix.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()), unix.O_RDONLY | unix.O_CLOEXEC, 0)
+    if err != nil { return -1, err }
+    defer unix.Close(orig)
+
+    if err := unix.Setns(target, unix.CLONE_NEWNET); err != nil {
+        return -1, fmt.Errorf("setns %s: %v", path, err)
+    }
+    fd, err := unix.Socket(domain, typ, proto)
+    if rerr := unix.Setns(orig, unix.CLONE_NEWNET); rerr != nil {
+        // thread would serve other goroutines in wrong namespace
+        panic(fmt.Errorf("Cannot return to original network namespace: %v", rerr))
+    }
+    return fd, err
+}
+
+func openEthToolSocket() error {
+    ethtoolSocketMutex.Lock()
+    defer ethtoolSocketMutex.Unlock()
+    if ethtool_socket >= 0 {
+        return nil
+    }
+    var fd int
+    var err error
+    if EthToolNetns != "" {
+        fd, err = socketInNetns(EthToolNetns, unix.AF_INET, unix.SOCK_DGRAM, unix.IPPROTO_IP)
+    } else {
+        fd, err = unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, unix.IPPROTO_IP)
+    }
+    if err != nil {
+        return err
+    }
+    ethtool_socket = fd
+    return nil
+}
+
+// ethtoolIoctl returns socket used, so that caller can reset exactly that socket
+func ethtoolIoctl(ifname [unix.IFNAMSIZ]byte, data uintptr) (int, error) {
+    ethtoolSocketMutex.RLock()
+    defer ethtoolSocketMutex.RUnlock()
+    fd := ethtool_socket
+    if fd < 0 {
+        // closed by other goroutine meanwhile
+        return fd, unix.EBADF
+    }
+
+    ifr := ifreq{
+        ifr_name: ifname,
+        ifr_data: data,
+    }
+
+    _, _, ep := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.SIOCETHTOOL, uintptr(unsafe.Pointer(&ifr)))
+    if ep != 0 {
+        return fd, ep
+    }
+
+    return fd, nil
+}
+
+// EthTool issues ioctl with ethtool command data on shared socket. Socket in bad state (EBADF, ENOTCONN) is reopened
+// and the call retried once.
+func EthTool(ifname [unix.IFNAMSIZ]byte, data uintptr) error {
+    for attempt := 0; ; attempt++ {
+        ethtoolSocketMutex.RLock()
+        opened := ethtool_socket >= 0
+        ethtoolSocketMutex.RUnlock()
+        if !opened {
+            if err := openEthToolSocket(); err != nil {
+                return err
+            }
+        }
+        fd, err := ethtoolIoctl(ifname, data)
+        if attempt > 0 || (err != unix.EBADF && err != unix.ENOTCONN) {
+            return err
+        }
+        resetEthToolSocket(fd)
+    }
+}
+
+type ethtoolModInfo struct {
+    cmd        uint32
+    tpe        uint32
+    eeprom_len uint32
+    reserved   [8]uint32
+}
+
+// ErrInterfaceRemoved is returned when network device disappeared (i.e. hot-unplug)
+var ErrInterfaceRemoved = errors.New("Interface removed")
+
+// ErrUnsupportedModule is wrapped by errors of module types that are not decoded
+var ErrUnsupportedModule = errors.New("Unsupported module type")
+
+func (e *EthToolModule) unsupported() error {
+    return fmt.Errorf("%w: %v", ErrUnsupportedModule, e.tpe)
+}
+
+// Name returns name of network interface of the module
+func (e *EthToolModule) Name() string {
+    return string(bytes.TrimRight(e.ifname[:], "\x00"))
+}
+
+// Type returns module type (ETH_MODULE_*), as reported by driver or overriden by ModuleTypeOverrides
+func (e *EthToolModule) Type() uint32 {
+    e.identify()
+    return e.tpe
+}
+
+// EepromLen returns number of EEPROM bytes readable by Read
+func (e *EthToolModule) EepromLen() uint32 {
+    e.identify()
+    return e.eeprom_len
+}
+
+func NewEthToolModule(ifname string) (*EthToolModule, error) {
+    var name [unix.IFNAMSIZ]byte
+    copy(name[:], []byte(ifname))
+    modInfo := ethtoolModInfo{cmd: unix.ETHTOOL_GMODULEINFO}
+    err := EthTool(name, uintptr(unsafe.Pointer(&modInfo)))
+    if err == unix.ENODEV {
+        return nil, ErrInterfaceRemoved
+    }
+    if err != nil {
+        return nil, err
+    }
+    ret := &EthToolModule{
+        ifname:     name,
+        driverTpe:  modInfo.tpe,
+        driverLen:  modInfo.eeprom_len,
+    }
+    tpe, overriden := ModuleTypeOverrides[ifname]
+    if overriden {
+        ret.driverTpe = tpe
+        if ret.driverLen == 0 {
+            ret.driverLen = moduleTypes[tpe].eeprom_len
+        }
+    }
+    ret.overriden = overriden
+    ret.tpe, ret.eeprom_len = ret.driverTpe, ret.driverLen
+    return ret, nil
+}
+
+type identifierEntry struct {
+    identifier byte
+    serial     string
+}
+
+// identifierCache remembers identifier of module in each interface together with its serial, so that
+// identifier is not read on every scrape. ModuleInfo drops entry whose serial no longer matches.
+var identifierCache = make(map[string]identifierEntry)
+
+// identify selects EEPROM layout by identifier (byte 0) on first use of module, so that the read
+// is spaced by Throttle and stopped by Context set after NewEthToolModule. Identifier of module
+// already seen in the interface is taken from identifierCache.
+func (e *EthToolModule) identify() error {
+    if e.identified {
+        return e.idErr
+    }
+    if !ModuleCacheDisabled {
+        moduleCacheMutex.Lock()
+        entry, found := identifierCache[e.Name()]
+        moduleCacheMutex.Unlock()
+        if found {
+            e.identified, e.idCached, e.idSerial = true, true, entry.serial
+            e.applyIdentifier(entry.identifier)
+            return nil
+        }
+    }
+    return e.readIdentifier()
+}
+
+// readIdentifier reads identifier and selects layout by it, dropping layout taken from identifierCache
+func (e *EthToolModule) readIdentifier() error {
+    e.tpe, e.eeprom_len, e.cmis = e.driverTpe, e.driverLen, false
+    e.identified, e.idCached, e.identifier, e.idErr = true, false, -1, nil
+    id, err := e.Read(0, 1)
+    qsfp := e.tpe == ETH_MODULE_SFF_8636 || e.tpe == ETH_MODULE_SFF_8436
+    if err != nil && qsfp {
+        e.idErr = err
+        return err
+    }
+    if err != nil || len(id) < 1 {
+        // layout of SFP is used even without identifier
+        return nil
+    }
+    e.identifier = int(id[0])
+    e.applyIdentifier(id[0])
+    return nil
+}
+
+func (e *EthToolModule) applyIdentifier(id byte) {
+    if e.driverTpe == ETH_MODULE_SFF_8636 || e.driverTpe == ETH_MODULE_SFF_8436 {
+        // CMIS modules are reported as QSFP by the ioctl, only identifier tells them apart
+        e.cmis = isCmisIdentifier(id)
+    }
+    if layout, found := IdentifierLayouts[id]; found && !e.overriden && !e.cmis && layout != e.tpe &&
+            !(e.tpe == ETH_MODULE_SFF_8079 && layout == ETH_MODULE_SFF_8472) {
+        // some drivers report type by cage (form factor), while optic uses other layout
+        e.tpe = layout
+        if e.eeprom_len > moduleTypes[layout].eeprom_len {
+            e.eeprom_len = moduleTypes[layout].eeprom_len
+        }
+    }
+}
+
+// IdentifierLayouts maps SFF-8024 identifier (byte 0) to module type whose EEPROM layout it uses.
+// It takes precedence over type reported by driver, but not over ModuleTypeOverrides.
+var IdentifierLayouts = map[byte]uint32{
+    0x03: ETH_MODULE_SFF_8472, // SFP, SFP+, SFP28
+    0x0c: ETH_MODULE_SFF_8436, // QSFP
+    0x0d: ETH_MODULE_SFF_8636, // QSFP+
+    0x11: ETH_MODULE_SFF_8636, // QSFP28
+}
+
+// ParseIdentifierLayout parses "identifier=type", i.e. "0x03=SFF-8636", and stores it in IdentifierLayouts
+func ParseIdentifierLayout(spec string) error {
+    eq := strings.IndexByte(spec, '=')
+    if eq < 0 {
+        return fmt.Errorf("Invalid identifier layout '%s', expected identifier=type", spec)
+    }
+    id, err := strconv.ParseUint(spec[:eq], 0, 8)
+    if err != nil { return fmt.Errorf("Invalid identifier '%s': %v", spec[:eq], err) }
+    tpe, err := ParseModuleType(spec[eq+1:])
+    if err != nil { return err }
+    IdentifierLayouts[byte(id)] = tpe
+    return nil
+}
+
+const (
+    ETH_MODULE_SFF_8079 = 0x1 // SFP without diagnostics, the same A0h layout as SFF-8472
+    ETH_MODULE_SFF_8472 = 0x2
+    ETH_MODULE_SFF_8636 = 0x3
+    ETH_MODULE_SFF_8436 = 0x4
+    ETH_MODULE_SFF_8472_LEN = 512
+)
+
+type moduleTypeDef struct {
+    name       string
+    eeprom_len uint32
+}
+
+var moduleTypes = map[uint32]moduleTypeDef{
+    ETH_MODULE_SFF_8079: { name: "SFF-8079", eeprom_len: 256 },
+    ETH_MODULE_SFF_8472: { name: "SFF-8472", eeprom_len: ETH_MODULE_SFF_8472_LEN },
+    ETH_MODULE_SFF_8636: { name: "SFF-8636", eeprom_len: 256 },
+    ETH_MODULE_SFF_8436: { name: "SFF-8436", eeprom_len: 256 },
+}
+
+// ModuleTypeOverrides replaces module type reported by driver for given interfaces
+var ModuleTypeOverrides = make(map[string]uint32)
+
+// ParseModuleType accepts module type name (i.e. "SFF-8472") or its number
+func ParseModuleType(name string) (uint32, error) {
+    for tpe, def := range(moduleTypes) {
+        if strings.EqualFold(def.name, name) {
+            return tpe, nil
+        }
+    }
+    var tpe uint32
+    if _, err := fmt.Sscanf(name, "%v", &tpe); err == nil {
+        if _, found := moduleTypes[tpe]; found {
+            return tpe, nil
+        }
+    }
+    return 0, fmt.Errorf("Unknown module type '%s'", name)
+}
+
+// SFF-8024 identifiers of modules using CMIS memory map
+const (
+    SFF8024_ID_QSFP_DD        = 0x18
+    SFF8024_ID_OSFP           = 0x19
+    SFF8024_ID_QSFP_PLUS_CMIS = 0x1e
+)
+
+func isCmisIdentifier(id byte) bool {
+    return id == SFF8024_ID_QSFP_DD || id == SFF8024_ID_OSFP || id == SFF8024_ID_QSFP_PLUS_CMIS
+}
+
+
+type ethtoolEeprom struct {
+    cmd    uint32
+    magic  uint32
+    offset uint32
+    len    uint32
+    data   [ETH_MODULE_SFF_8472_LEN]byte
+}
+
+func (e *EthToolModule) Read(offset uint32, len uint32) ([]byte, error) {
+    if e.eeprom_len < 1 {
+        return nil, errors.New("ethtool: No EEPROM to read.")
+    }
+    if offset > e.eeprom_len {
+        return nil, errors.New("ethtool: Offset out of bounds.")
+    }
+    if offset == e.eeprom_len {
+        return nil, nil
+    }
+    if e.eeprom_len - offset < len {
+        len = e.eeprom_len - offset
+    }
+    if len > ETH_MODULE_SFF_8472_LEN {
+        // kernel would write past data, callers get short read and read the rest again
+        len = ETH_MODULE_SFF_8472_LEN
+    }
+    e.Throttle.Wait()
+    if err := e.Abandoned(); err != nil {
+        return nil, err
+    }
+    if e.reader != nil {
+        return e.reader(offset, len)
+    }
+    // fresh zeroed buffer on every read, so that nothing of other read can leak into result
+    eeprom := ethtoolEeprom{
+        cmd: unix.ETHTOOL_GMODULEEEPROM,
+        offset: offset,
+        len: len,
+    }
+    err := EthTool(e.ifname, uintptr(unsafe.Pointer(&eeprom)))
+    if err != nil { return nil, err }
+    if eeprom.len < len {
+        // kernel writes back number of bytes actually copied, it is short when driver failed in the middle
+        len = eeprom.len
+    }
+    return eeprom.data[:len], nil
+}
+
+// Abandoned returns error of Context once it is done, i.e. when collection was abandoned after timeout
+func (e *EthToolModule) Abandoned() error {
+    if e.Context == nil {
+        return nil
+    }
+    return e.Context.Err()
+}
+
+// identityRegion returns offset and length of static identity area of EEPROM
+func (e *EthToolModule) identityRegion() (uint32, uint32, error) {
+    if err := e.identify(); err != nil { return 0, 0, err }
+    switch {
+        case e.tpe == ETH_MODULE_SFF_8472 || e.tpe == ETH_MODULE_SFF_8079:
+            return 0, 0x60, nil  // A0h base and extended ID fields including CC_EXT
+        case e.cmis:
+            return 0x80, 0x80, nil  // upper page 00h
+        default:
+            return 0, 0, e.unsupported()
+    }
+}
+
+// IdentityHash returns hex encoded SHA-256 of static identity area of EEPROM
+func (e *EthToolModule) IdentityHash() (string, error) {
+    offset, length, err := e.identityRegion()
+    if err != nil { return "", err }
+    data, err := e.Read(offset, length)
+    if err != nil { return "", err }
+    if uint32(len(data)) < length {
+        // hash of partial area would report changed EEPROM
+        return "", errors.New("ethtool: Short read.")
+    }
+    sum := sha256.Sum256(data)
+    return hex.EncodeToString(sum[:]), nil
+}
+
+// ReadAll reads whole EEPROM of the module
+func (e *EthToolModule) ReadAll() ([]byte, error) {
+    if err := e.identify(); err != nil { return nil, err }
+    ret := make([]byte, 0, e.eeprom_len)
+    for offset := uint32(0); offset < e.eeprom_len; {
+        data, err := e.Read(offset, ETH_MODULE_SFF_8472_LEN)
+        if err != nil { return nil, err }
+        if len(data) == 0 { break }
+        ret = append(ret, data...)
+        offset += uint32(len(data))
+    }
+    return ret, nil
+}
+
+const (
+    txr_MULT_C  = 1.0/256.0
+    txr_MULT_V  = 1.0/10000.0
+    txr_MULT_mA = 1.0/500.0
+    txr_MULT_mW = 1.0/10000.0
+)
+
+// TxrDiag reads diagnostic monitors. It returns nil diagnostics without error
+// when module does not provide them.
+func (e *EthToolModule) TxrDiag() (*TranscieverDiagnostics, error) {
+    if err := e.identify(); err != nil { return nil, err }
+    if e.tpe == ETH_MODULE_SFF_8079 {
+        e.ddmUnavailable = "sff8079"
+        return nil, nil
+    }
+    if e.tpe != ETH_MODULE_SFF_8472 {
+        return nil, e.unsupported()
+    }
+/*
+    ethtool -m enp129s0f0 offset 0x160 length 10
+    Offset          Values
+    ------          ------
+    0x0160:         27 09 80 79 0b 5d 14 ce 16 02 
+                    TT TT VV VV CC CC OO OO RR RR
+
+    network endianity
+    TT TT temperature                           in   1/256 C  (0.00390625 C)
+    VV VV Module voltage                        in 1/10000 V  (0.0001 V)
+    CC CC Laser bias current                    in  2/1000 A  (2 mA)
+    OO OO Laser output power                    in 1/10000 mW (0.0001 mW);  dBm = log(mW)/log(10)*10
+    RR RR Receiver signal average optical power in 1/10000 mw (0.0001 mW);  dBm = log(mW)/log(10)*10
+
+    0x016e: status/control bits (A2h byte 110)
+        bit 7 TX disable state, bit 2 TX fault state, bit 1 RX LOS state, bit 0 data ready (inverted)
+*/
+
+    if e.eeprom_len <= 0x160 {
+        // Module without A2h page (SFF-8472 length 256), there are no diagnostics. Optic may
+        // still advertise them, but require address change (A0h byte 92 bit 2) the driver does not do.
+        e.ddmUnavailable = "no_a2h_page"
+        if ddm, err := e.Read(0x5c, 1); err == nil && len(ddm) == 1 && ddm[0] & (1 << 6) != 0 && ddm[0] & (1 << 2) != 0 {
+            e.ddmUnavailable = "address_change_unsupported"
+        }
+        return nil, nil
+    }
+    data, err := e.Read(0x160, 15)
+    if err != nil { return nil, err }
+    if len(data) < 10 {
+        e.ddmUnavailable = "short_read"
+        return nil, nil
+    }
+    if blank(data[:10]) {
+        // driver returned A2h page, but nothing answered on its address
+        e.ddmUnavailable = "a2h_blank"
+        return nil, nil
+    }
+    ret := decodeMonitors(data)
+    if len(data) >= 15 {
+        status := data[14]
+        ret.HaveStatus = true
+        ret.TxDisable  = status & (1 << 7) != 0
+        ret.TxFault    = status & (1 << 2) != 0
+        ret.RxLos      = status & (1 << 1) != 0
+        ret.DataReady  = status & (1 << 0) == 0
+    }
+    if AuxMonitorsEnabled && len(data) >= 14 {
+        // AUX monitors are optional, so failure to read their types is not an error
+        if types, err := e.Read(0x62, 1); err == nil && len(types) == 1 {
+            ret.Aux = decodeAux(types[0], data[10:14])
+        }
+    }
+    return ret, nil
+}
+
+// DdmUnavailableReason explains why last TxrDiag returned no diagnostics without error:
+// sff8079, no_a2h_page, address_change_unsupported, short_read or a2h_blank. It is empty otherwise.
+func (e *EthToolModule) DdmUnavailableReason() string {
+    return e.ddmUnavailable
+}
+
+// blank tells whether data are all 0x00 or all 0xff
+func blank(data []byte) bool {
+    zeros, ones := true, true
+    for _, b := range(data) {
+        zeros = zeros && b == 0x00
+        ones  = ones && b == 0xff
+    }
+    return zeros || ones
+}
+
+// LineSideDiag reads secondary (line side) monitors of optics with retimer or gearbox,
+// that have the same layout as A2h bytes 96-105 at given flat offset
+func (e *EthToolModule) LineSideDiag(offset uint32) (*TranscieverDiagnostics, error) {
+    if err := e.identify(); err != nil { return nil, err }
+    if e.tpe != ETH_MODULE_SFF_8472 || offset + 10 > e.eeprom_len {
+        return nil, nil
+    }
+    data, err := e.Read(offset, 10)
+    if err != nil { return nil, err }
+    if len(data) < 10 {
+        return nil, nil
+    }
+    return decodeMonitors(data), nil
+}
+
+// decodeMonitors decodes temperature, voltage, bias, tx and rx power words
+func decodeMonitors(data []byte) *TranscieverDiagnostics {
+    var w [5]float64
+    for i := 0; i < 5; i++ {
+        w[i] = float64(binary.BigEndian.Uint16(data[i*2:i*2+2]))
+    }
+    tx := w[3] * txr_MULT_mW
+    rx := w[4] * txr_MULT_mW
+    return &TranscieverDiagnostics {
+        TemperatureC: w[0] * txr_MULT_C,
+        VoltageV:     w[1] * txr_MULT_V,
+        BiasMA:       w[2] * txr_MULT_mA,
+        TransmitMW:   tx,
+        ReceiveMW:    rx,
+        TransmitDBm:  PowerDecibels(tx, 1),
+        ReceiveDBm:   PowerDecibels(rx, 1),
+    }
+}
+
+const (
+    txr_DECODE_STRING = iota
+    txr_DECODE_INT
+    txr_DECODE_OUI
+    txr_DECODE_OPTIONS
+    txr_DECODE_ENHANCED_OPTIONS
+    txr_DECODE_HEX
+    txr_DECODE_POWER
+    txr_DECODE_DDM_TYPE
+    txr_DECODE_SFF8472_REV
+    txr_DECODE_EXT_COMPLIANCE
+    txr_DECODE_ENCODING
+    txr_DECODE_RATE_ID
+    txr_DECODE_CONNECTOR
+    txr_DECODE_CLEI
+    txr_DECODE_BITRATE
+    txr_DECODE_BITRATE_EXT
+)
+
+// CLEI_LENGTH is length of CLEI code, commonly stored in vendor specific area of A0h page
+const CLEI_LENGTH = 10
+
+var txrDecoderNames = map[string]int{
+    "string": txr_DECODE_STRING,
+    "int":    txr_DECODE_INT,
+    "oui":    txr_DECODE_OUI,
+    "hex":    txr_DECODE_HEX,
+    "clei":   txr_DECODE_CLEI,
+}
+
+type EepromEntryDef struct {
+    name    string
+    offset  uint32
+    length  uint32
+    flag    int
+    decoder int
+}
+
+// fromLatin1 decodes space padded string. Field is cut at first NUL (some vendors
+// leave garbage after it) and trailing spaces and 0xFF padding is removed.
+func fromLatin1(bytes []byte) (string) {
+    l := len(bytes)
+    output := make([]rune, l)
+    lastchar := 0
+    for i, b := range(bytes) {
+        if b == 0 {
+            break
+        }
+        if (b != 0x20 && b != 0xff) {
+            lastchar = i + 1
+        }
+        output[i] = rune(b)
+    }
+    return string(output[:lastchar])
+}
+
+// ParseMfgDate parses date code (A0h bytes 84-91, CMIS page 00h bytes 182-189): YYMMDD followed by optional lot code
+func ParseMfgDate(date string) (time.Time, bool) {
+    if len(date) < 6 {
+        return time.Time{}, false
+    }
+    t, err := time.Parse("060102", date[:6])
+    if err != nil {
+        return time.Time{}, false
+    }
+    return t, true
+}
+
+func ValidSerial(sn string) bool {
+    other_chars := 0
+    alnum := 0
+    for _, r := range(sn) {
+        if r < ' ' || r > '~' {
+            other_chars ++
+        } else if ( r >= '0' && r <= '9' ) || ( r >= 'A' && r <= 'Z') || ( r >= 'a' && r <= 'z' ) {
+            alnum ++
+        }
+    }
+    return alnum > 3 && other_chars == 0
+}
+
+// GAP_MERGE is the largest number of unused bytes between two fields that are still read together,
+// i.e. fields 0x10-0x14 and 0x18-0x1c are read at once, while 0x10-0x14 and 0x19-0x1d are read separately.
+const GAP_MERGE = 4
+const infty = 0xffff
+
+var txrEepromStatic = [...]EepromEntryDef{
+    // Must be sorted by offset
+    { name: "connector", offset: 0x02,  length: 1,  flag: TXR_MI_COMPLIANCE, decoder: txr_DECODE_CONNECTOR, },
+    { name: "encoding",  offset: 0x0b,  length: 1,  flag: TXR_MI_COMPLIANCE, decoder: txr_DECODE_ENCODING, },
+    { name: "bitrate",   offset: 0x0c,  length: 1,  flag: TXR_MI_COMPLIANCE, decoder: txr_DECODE_BITRATE, },
+    { name: "rate_id",   offset: 0x0d,  length: 1,  flag: TXR_MI_COMPLIANCE, decoder: txr_DECODE_RATE_ID, },
+    { name: "vendor",    offset: 0x14,  length: 16, flag: TXR_MI_VENDOR,   decoder: txr_DECODE_STRING, },
+    { name: "ext_compliance", offset: 0x24, length: 1, flag: TXR_MI_COMPLIANCE, decoder: txr_DECODE_EXT_COMPLIANCE, },
+    { name: "oui",       offset: 0x25,  length: 3,  flag: TXR_MI_OUI,      decoder: txr_DECODE_OUI,    },
+    { name: "product",   offset: 0x28,  length: 16, flag: TXR_MI_PRODUCT,  decoder: txr_DECODE_STRING, },
+    { name: "revision",  offset: 0x38,  length: 4,  flag: TXR_MI_REVISION, decoder: txr_DECODE_STRING, },
+    { name: "wavelen",   offset: 0x3c,  length: 2,  flag: TXR_MI_WAVELEN,  decoder: txr_DECODE_INT,    },
+    { name: "options",   offset: 0x40,  length: 2,  flag: TXR_MI_OPTIONS,  decoder: txr_DECODE_OPTIONS, },
+    { name: "bitrate_ext", offset: 0x42, length: 1, flag: TXR_MI_COMPLIANCE, decoder: txr_DECODE_BITRATE_EXT, },
+    { name: "serial",    offset: 0x44,  length: 16, flag: TXR_MI_SERIAL,   decoder: txr_DECODE_STRING, },
+    { name: "mfgdate",   offset: 0x54,  length: 8,  flag: TXR_MI_DATE,     decoder: txr_DECODE_STRING, },
+    { name: "ddm_type",  offset: 0x5c,  length: 1,  flag: TXR_MI_DDM,      decoder: txr_DECODE_DDM_TYPE, },
+    { name: "enhanced_options", offset: 0x5d, length: 1, flag: TXR_MI_OPTIONS, decoder: txr_DECODE_ENHANCED_OPTIONS, },
+    { name: "sff8472_rev", offset: 0x5e, length: 1, flag: TXR_MI_COMPLIANCE, decoder: txr_DECODE_SFF8472_REV, },
+    // A2h alarm and warning thresholds, in mW
+    { name: "tx_power_low_warn", offset: 0x11e, length: 2, flag: TXR_MI_THRESHOLDS, decoder: txr_DECODE_POWER, },
+    { name: "rx_power_low_warn", offset: 0x126, length: 2, flag: TXR_MI_THRESHOLDS, decoder: txr_DECODE_POWER, },
+    { name: "--last--",  offset: infty, length: 0,  flag: 0,               decoder: 0},
+}
+
+type optionBit struct {
+    byte int  // index into decoded buffer
+    bit  uint
+    name string
+}
+
+// A0h bytes 64-65
+var txrOptionBits = [...]optionBit{
+    { byte: 0, bit: 0, name: "linear_rx_output"         },
+    { byte: 0, bit: 1, name: "power_level_2"            },
+    { byte: 0, bit: 2, name: "cooled"                   },
+    { byte: 0, bit: 3, name: "retimer_cdr"              },
+    { byte: 0, bit: 4, name: "paging"                   },
+    { byte: 0, bit: 5, name: "power_level_3"            },
+    { byte: 1, bit: 1, name: "rx_los"                   },
+    { byte: 1, bit: 2, name: "rx_los_inverted"          },
+    { byte: 1, bit: 3, name: "tx_fault"                 },
+    { byte: 1, bit: 4, name: "tx_disable"               },
+    { byte: 1, bit: 5, name: "rate_select"              },
+    { byte: 1, bit: 6, name: "tunable_tx"               },
+    { byte: 1, bit: 7, name: "rx_decision_threshold"    },
+}
+
+// A0h byte 93
+var txrEnhancedOptionBits = [...]optionBit{
+    { byte: 0, bit: 1, name: "soft_rate_select_8431"    },
+    { byte: 0, bit: 2, name: "application_select_8079"  },
+    { byte: 0, bit: 3, name: "soft_rate_select"         },
+    { byte: 0, bit: 4, name: "soft_rx_los"              },
+    { byte: 0, bit: 5, name: "soft_tx_fault"            },
+    { byte: 0, bit: 6, name: "soft_tx_disable"          },
+    { byte: 0, bit: 7, name: "alarm_warning_flags"      },
+}
+
+// TxrOptionNames lists all options that can appear in "options" and "enhanced_options" tags
+func TxrOptionNames() []string {
+    ret := make([]string, 0, len(txrOptionBits) + len(txrEnhancedOptionBits))
+    for _, o := range(txrOptionBits) { ret = append(ret, o.name) }
+    for _, o := range(txrEnhancedOptionBits) { ret = append(ret, o.name) }
+    return ret
+}
+
+// powerClassWatts is maximum power consumption of SFP power levels (SFF-8472 A0h byte 64 bits 1 and 5, SFF-8431)
+var powerClassWatts = [...]float64{ 1: 1.0, 2: 1.5, 3: 2.0 }
+
+// PowerClass returns power level declared in "options" tag and its maximum power consumption in watts
+func PowerClass(options string) (int, float64) {
+    class := 1
+    for _, option := range(strings.Split(options, ",")) {
+        switch {
+            case option == "power_level_3":
+                class = 3
+            case option == "power_level_2" && class < 2:
+                class = 2
+        }
+    }
+    return class, powerClassWatts[class]
+}
+
+// decodeOptions returns comma separated names of bits that are set
+func decodeOptions(buf []byte, bits []optionBit) string {
+    ret := make([]string, 0, len(bits))
+    for _, o := range(bits) {
+        if buf[o.byte] & (1 << o.bit) != 0 {
+            ret = append(ret, o.name)
+        }
+    }
+    return strings.Join(ret, ",")
+}
+
+var cmisEepromStatic = [...]EepromEntryDef{
+    // Upper page 00h, must be sorted by offset
+    { name: "vendor",    offset: 0x81,  length: 16, flag: TXR_MI_VENDOR,   decoder: txr_DECODE_STRING, },
+    { name: "oui",       offset: 0x91,  length: 3,  flag: TXR_MI_OUI,      decoder: txr_DECODE_OUI,    },
+    { name: "product",   offset: 0x94,  length: 16, flag: TXR_MI_PRODUCT,  decoder: txr_DECODE_STRING, },
+    { name: "revision",  offset: 0xa4,  length: 2,  flag: TXR_MI_REVISION, decoder: txr_DECODE_STRING, },
+    { name: "serial",    offset: 0xa6,  length: 16, flag: TXR_MI_SERIAL,   decoder: txr_DECODE_STRING, },
+    { name: "mfgdate",   offset: 0xb6,  length: 8,  flag: TXR_MI_DATE,     decoder: txr_DECODE_STRING, },
+    { name: "--last--",  offset: infty, length: 0,  flag: 0,               decoder: 0},
+}
+
+// txrEepromTable is txrEepromStatic extended by user supplied fields
+var txrEepromTable = txrEepromStatic[:]
+
+var fieldNameRegex = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// Name returns name of user field, that is also name of its tag
+func (def EepromEntryDef) Name() string {
+    return def.name
+}
+
+// ParseEepromField parses user field definition "name:offset:length:decoder",
+// i.e. "asset_tag:0x60:16:string". Offset is within A0h page.
+func ParseEepromField(spec string) (EepromEntryDef, error) {
+    return parseEepromField(spec, 0, 0x00, 0x100, "A0h page")
+}
+
+// ParseVendorPageField parses user field definition like ParseEepromField, but offset is within
+// vendor specific area of A2h page (0x80-0xff), i.e. "temp2:0x80:2:int". Field is read at absolute
+// offset 0x100 + offset, so it is skipped for modules with shorter EEPROM (see ValidateTable).
+func ParseVendorPageField(spec string) (EepromEntryDef, error) {
+    return parseEepromField(spec, 0x100, 0x80, 0x100, "vendor area of A2h page (0x80-0xff)")
+}
+
+// parseEepromField parses field with offset in range [low, high) of page starting at absolute offset base
+func parseEepromField(spec string, base, low, high uint64, area string) (EepromEntryDef, error) {
+    parts := strings.Split(spec, ":")
+    if len(parts) != 4 {
+        return EepromEntryDef{}, fmt.Errorf("Invalid field '%s', expected name:offset:length:decoder", spec)
+    }
+    if !fieldNameRegex.MatchString(parts[0]) {
+        return EepromEntryDef{}, fmt.Errorf("Invalid field name '%s'", parts[0])
+    }
+    offset, err := strconv.ParseUint(parts[1], 0, 32)
+    if err != nil { return EepromEntryDef{}, fmt.Errorf("Invalid offset of field '%s': %v", parts[0], err) }
+    length, err := strconv.ParseUint(parts[2], 0, 32)
+    if err != nil { return EepromEntryDef{}, fmt.Errorf("Invalid length of field '%s': %v", parts[0], err) }
+    decoder, found := txrDecoderNames[parts[3]]
+    if !found {
+        return EepromEntryDef{}, fmt.Errorf("Unknown decoder '%s' of field '%s'", parts[3], parts[0])
+    }
+    if length < 1 || offset < low || offset + length > high {
+        return EepromEntryDef{}, fmt.Errorf("Field '%s' does not fit into %s", parts[0], area)
+    }
+    if decoder == txr_DECODE_OUI && length != 3 {
+        return EepromEntryDef{}, fmt.Errorf("Field '%s' with oui decoder must have length 3", parts[0])
+    }
+    return EepromEntryDef{
+        name:    parts[0],
+        offset:  uint32(base + offset),
+        length:  uint32(length),
+        flag:    TXR_MI_CUSTOM,
+        decoder: decoder,
+    }, nil
+}
+
+// AddEepromField inserts user field into SFF-8472 table, keeping it sorted by offset.
+// Field must not overlap any other field nor reuse its name.
+func AddEepromField(def EepromEntryDef) error {
+    table := make([]EepromEntryDef, 0, len(txrEepromTable) + 1)
+    for _, other := range(txrEepromTable) {
+        if other.name == def.name {
+            return fmt.Errorf("Field '%s' already exists", def.name)
+        }
+        if other.offset < def.offset + def.length && def.offset < other.offset + other.length {
+            return fmt.Errorf("Field '%s' overlaps field '%s'", def.name, other.name)
+        }
+    }
+    inserted := false
+    for _, other := range(txrEepromTable) {
+        if !inserted && def.offset < other.offset {
+            table = append(table, def)
+            inserted = true
+        }
+        table = append(table, other)
+    }
+    txrEepromTable = table
+    return nil
+}
+
+func GetTxrInfoFlags(str []string) (int, error) {
+    ret := 0
+    for _, info := range(str) {
+        switch info {
+            case "ALL":
+                ret = ret | TXR_MI_ALL
+            case "CACHE":
+                ret = ret | TXR_MI_ALLOW_CACHE
+            case "partial_read", "alias", "diag_supported", "rx_power_type", "suspect":
+                // not EEPROM entries, set by moduleInfo when some reads failed, from sysfs ifalias
+                // and with -unsupported-as-present, rx_power_type is derived from ddm_type,
+                // suspect lists values out of bounds
+            default:
+                found := false
+                for _, def := range(txrEepromTable) {
+                    if info == def.name {
+                        found = true
+                        ret = ret | def.flag
+                    }
+                }
+                if !found {
+                    return 0, fmt.Errorf("Unknown entry '%s'", info)
+                }
+        }
+    }
+    return ret, nil
+}
+
+type bufferInfo struct {
+    def     int
+    buf_pos uint32
+}
+
+func decodeStatic(buf []byte, decoder int) string {
+    switch decoder {
+        case txr_DECODE_STRING:
+            return fromLatin1(buf)
+        case txr_DECODE_OUI:
+            return fmt.Sprintf("%02x:%02x:%02x",buf[0], buf[1], buf[2])
+        case txr_DECODE_INT:
+            acc := 0
+            for _, d := range(buf) {
+                acc = 256 * acc + int(d)
+            }
+            return fmt.Sprintf("%d", acc)
+        case txr_DECODE_OPTIONS:
+            return decodeOptions(buf, txrOptionBits[:])
+        case txr_DECODE_ENHANCED_OPTIONS:
+            return decodeOptions(buf, txrEnhancedOptionBits[:])
+        case txr_DECODE_HEX:
+            return hex.EncodeToString(buf)
+        case txr_DECODE_CLEI:
+            return decodeClei(buf)
+        case txr_DECODE_POWER:
+            return strconv.FormatFloat(float64(binary.BigEndian.Uint16(buf)) * txr_MULT_mW, 'g', -1, 64)
+        case txr_DECODE_DDM_TYPE:
+            return decodeDdmType(buf[0])
+        case txr_DECODE_ENCODING:
+            if encoding, found := encodingCodes[buf[0]]; found {
+                return encoding
+            }
+            return fmt.Sprintf("unknown_0x%02x", buf[0])
+        case txr_DECODE_CONNECTOR:
+            if connector, found := connectorCodes[buf[0]]; found {
+                return connector
+            }
+            return fmt.Sprintf("unknown_0x%02x", buf[0])
+        case txr_DECODE_RATE_ID:
+            if rate, found := rateIdentifiers[buf[0]]; found {
+                return rate
+            }
+            return fmt.Sprintf("unknown_0x%02x", buf[0])
+        case txr_DECODE_EXT_COMPLIANCE:
+            if spec, found := extComplianceCodes[buf[0]]; found {
+                return spec
+            }
+            return fmt.Sprintf("unknown_0x%02x", buf[0])
+        case txr_DECODE_BITRATE:
+            if buf[0] == 0xff {
+                return "extended"
+            }
+            return strconv.Itoa(int(buf[0]) * 100)
+        case txr_DECODE_BITRATE_EXT:
+            return strconv.Itoa(int(buf[0]) * 250)
+        case txr_DECODE_SFF8472_REV:
+            if int(buf[0]) < len(sff8472Revisions) {
+                return sff8472Revisions[buf[0]]
+            }
+            return fmt.Sprintf("unknown_0x%02x", buf[0])
+        default:
+            panic("Invalid eeprom definition")
+    }
+}
+
+// resolveBitrate sets nominal bitrate (Mbps) above 25.4 GBd, which A0h byte 12 marks by 0xff,
+// from byte 66 (units of 250 MBd). Byte 66 is not exported on its own.
+func resolveBitrate(ret map[string]string) {
+    ext, found := ret["bitrate_ext"]
+    delete(ret, "bitrate_ext")
+    if ret["bitrate"] != "extended" {
+        return
+    }
+    if found {
+        ret["bitrate"] = ext
+    } else {
+        delete(ret, "bitrate")
+    }
+}
+
+// decodeClei returns CLEI code, or empty string when field does not look like one
+// (blank or other vendor data in vendor specific area)
+func decodeClei(buf []byte) string {
+    clei := fromLatin1(buf)
+    if len(clei) != CLEI_LENGTH {
+        return ""
+    }
+    for _, c := range(clei) {
+        if !(c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+            return ""
+        }
+    }
+    return clei
+}
+
+// extComplianceCodes are extended specification compliance codes (SFF-8024 table 4-4), A0h byte 36
+var extComplianceCodes = map[byte]string{
+    0x00: "unspecified",
+    0x01: "100G AOC or 25GAUI C2M AOC (BER 5e-5)",
+    0x02: "100GBASE-SR4 or 25GBASE-SR",
+    0x03: "100GBASE-LR4 or 25GBASE-LR",
+    0x04: "100GBASE-ER4 or 25GBASE-ER",
+    0x05: "100GBASE-SR10",
+    0x06: "100G CWDM4",
+    0x07: "100G PSM4 Parallel SMF",
+    0x08: "100G ACC or 25GAUI C2M ACC (BER 5e-5)",
+    0x0b: "100GBASE-CR4 or 25GBASE-CR CA-L",
+    0x0c: "25GBASE-CR CA-S",
+    0x0d: "25GBASE-CR CA-N",
+    0x10: "40GBASE-ER4",
+    0x11: "4 x 10GBASE-SR",
+    0x12: "40G PSM4 Parallel SMF",
+    0x13: "G959.1 profile P1I1-2D1",
+    0x14: "G959.1 profile P1S1-2D2",
+    0x15: "G959.1 profile P1L1-2D2",
+    0x16: "10GBASE-T with SFI electrical interface",
+    0x17: "100G CLR4",
+    0x18: "100G AOC or 25GAUI C2M AOC (BER 1e-12)",
+    0x19: "100G ACC or 25GAUI C2M ACC (BER 1e-12)",
+    0x1a: "100GE-DWDM2",
+    0x1b: "100G 1550nm WDM",
+    0x1c: "10GBASE-T Short Reach",
+    0x1d: "5GBASE-T",
+    0x1e: "2.5GBASE-T",
+    0x1f: "40G SWDM4",
+    0x20: "100G SWDM4",
+    0x21: "100G PAM4 BiDi",
+    0x22: "4WDM-10 MSA",
+    0x23: "4WDM-20 MSA",
+    0x24: "4WDM-40 MSA",
+    0x25: "100GBASE-DR",
+    0x26: "100G-FR or 100GBASE-FR1",
+    0x27: "100G-LR or 100GBASE-LR1",
+    0x40: "50GBASE-CR, 100GBASE-CR2 or 200GBASE-CR4",
+    0x41: "50GBASE-SR, 100GBASE-SR2 or 200GBASE-SR4",
+    0x42: "50GBASE-FR or 200GBASE-DR4",
+    0x43: "200GBASE-FR4",
+    0x44: "200G 1550nm PSM4",
+    0x45: "50GBASE-LR",
+    0x46: "200GBASE-LR4",
+}
+
+// encodingCodes are serial encoding codes (SFF-8024 table 4-2), A0h byte 11
+var encodingCodes = map[byte]string{
+    0x00: "unspecified",
+    0x01: "8B/10B",
+    0x02: "4B/5B",
+    0x03: "NRZ",
+    0x04: "Manchester",
+    0x05: "SONET scrambled",
+    0x06: "64B/66B",
+    0x07: "256B/257B",
+    0x08: "PAM4",
+}
+
+// connectorCodes are connector types (SFF-8024 table 4-3), A0h byte 2
+var connectorCodes = map[byte]string{
+    0x00: "unspecified",
+    0x01: "SC",
+    0x02: "FC style 1",
+    0x03: "FC style 2",
+    0x04: "BNC/TNC",
+    0x05: "FC coax",
+    0x06: "FiberJack",
+    0x07: "LC",
+    0x08: "MT-RJ",
+    0x09: "MU",
+    0x0a: "SG",
+    0x0b: "optical pigtail",
+    0x0c: "MPO 1x12",
+    0x0d: "MPO 2x16",
+    0x20: "HSSDC II",
+    0x21: "copper pigtail",
+    0x22: "RJ45",
+    0x23: "no separable connector",
+    0x24: "MXC 2x16",
+    0x25: "CS",
+    0x26: "SN",
+    0x27: "MPO 2x12",
+    0x28: "MPO 1x16",
+}
+
+// bidiPartners are receive wavelengths of usual BiDi pairs by transmit wavelength (nm).
+// 1310 nm is paired with both 1490 and 1550 nm, so its partner is unknown.
+var bidiPartners = map[int]int{
+    1270: 1330,
+    1330: 1270,
+    1490: 1310,
+    1550: 1310,
+}
+
+// bidiProductRegex matches part numbers of BiDi optics, i.e. "SFP-10G-BX10-D" or "GLC-BX-U"
+var bidiProductRegex = regexp.MustCompile(`(?i)(^|[^A-Z])(BX|BIDI|BD)([^A-Z]|$)`)
+
+// DetectBidi guesses from identity tags whether optic is bidirectional (single fiber) and returns its
+// transmit and receive wavelength (0 when unknown). SFF-8472 has no BiDi indication nor receive
+// wavelength, so it relies on part number naming and usual wavelength pairs: optics with unusual
+// part numbers are not detected and receive wavelength of 1310 nm transmitters is never known.
+func DetectBidi(tags map[string]string) (bool, int, int) {
+    switch tags["connector"] {
+        case "copper pigtail", "RJ45", "no separable connector", "MPO 1x12", "MPO 2x16", "MPO 2x12", "MPO 1x16":
+            return false, 0, 0
+    }
+    if !bidiProductRegex.MatchString(tags["product"]) {
+        return false, 0, 0
+    }
+    tx, _ := strconv.Atoi(tags["wavelen"])
+    return true, tx, bidiPartners[tx]
+}
+
+// rateIdentifiers are rate select functionality codes (SFF-8472 table 5-6), A0h byte 13
+var rateIdentifiers = map[byte]string{
+    0x00: "unspecified",
+    0x01: "SFF-8079 4/2/1G rate select and AS0/AS1",
+    0x02: "SFF-8431 8/4/2G rx rate select",
+    0x04: "SFF-8431 8/4/2G tx rate select",
+    0x06: "SFF-8431 8/4/2G independent rx and tx rate select",
+    0x08: "FC-PI-5 16/8/4G rx rate select",
+    0x0a: "FC-PI-5 16/8/4G independent rx and tx rate select",
+    0x0c: "FC-PI-6 32/16/8G independent rx and tx rate select",
+    0x0e: "10/8G rx and tx rate select",
+    0x10: "FC-PI-7 64/32/16G independent rx and tx rate select",
+    0x20: "rate select based on PMDs (A0h byte 36, A2h byte 67)",
+}
+
+// sff8472Revisions are indexed by SFF-8472 compliance code, A0h byte 94
+var sff8472Revisions = [...]string{"none", "9.3", "9.5", "10.2", "10.4", "11.0", "11.3", "11.4", "12.3", "12.4"}
+
+/* Diagnostic monitoring type, A0h byte 92
+    bit 6 digital diagnostics implemented
+    bit 5 internally calibrated, bit 4 externally calibrated
+    bit 3 received power measurement: 0 = OMA, 1 = average power
+    bit 2 address change required to access A2h
+*/
+// RxPowerType returns "average" or "oma" measurement type of receiver power (A0h byte 92 bit 3)
+// from decoded ddm_type, empty for transciever without diagnostics
+func RxPowerType(ddmType string) string {
+    for _, part := range(strings.Split(ddmType, ",")) {
+        if part == "average" || part == "oma" {
+            return part
+        }
+    }
+    return ""
+}
+
+func decodeDdmType(b byte) string {
+    if b & (1 << 6) == 0 {
+        return "none"
+    }
+    ret := make([]string, 0, 3)
+    switch {
+        case b & (1 << 5) != 0: ret = append(ret, "internal")
+        case b & (1 << 4) != 0: ret = append(ret, "external")
+    }
+    if b & (1 << 3) != 0 {
+        ret = append(ret, "average")
+    } else {
+        ret = append(ret, "oma")
+    }
+    if b & (1 << 2) != 0 {
+        ret = append(ret, "address_change")
+    }
+    return strings.Join(ret, ",")
+}
+
+// Identity fields at the same offsets in all SFP (A0h) or all QSFP (upper page 00h) modules
+var sfpBaseIdentity = [...]EepromEntryDef{
+    { name: "vendor",    offset: 0x14,  length: 16, flag: TXR_MI_VENDOR,   decoder: txr_DECODE_STRING, },
+    { name: "product",   offset: 0x28,  length: 16, flag: TXR_MI_PRODUCT,  decoder: txr_DECODE_STRING, },
+    { name: "serial",    offset: 0x44,  length: 16, flag: TXR_MI_SERIAL,   decoder: txr_DECODE_STRING, },
+    { name: "--last--",  offset: infty, length: 0,  flag: 0,               decoder: 0},
+}
+var qsfpBaseIdentity = [...]EepromEntryDef{
+    { name: "vendor",    offset: 0x94,  length: 16, flag: TXR_MI_VENDOR,   decoder: txr_DECODE_STRING, },
+    { name: "product",   offset: 0xa8,  length: 16, flag: TXR_MI_PRODUCT,  decoder: txr_DECODE_STRING, },
+    { name: "serial",    offset: 0xc4,  length: 16, flag: TXR_MI_SERIAL,   decoder: txr_DECODE_STRING, },
+    { name: "--last--",  offset: infty, length: 0,  flag: 0,               decoder: 0},
+}
+
+// BaseIdentity reads vendor, product and serial of modules that are not fully decoded
+func (e *EthToolModule) BaseIdentity() (map[string]string, error) {
+    if err := e.identify(); err != nil { return nil, err }
+    switch e.tpe {
+        case ETH_MODULE_SFF_8636, ETH_MODULE_SFF_8436:
+            return e.readTable(qsfpBaseIdentity[:], TXR_MI_ALL)
+        default:
+            return e.readTable(sfpBaseIdentity[:], TXR_MI_ALL)
+    }
+}
+
+func (e *EthToolModule) staticTable() ([]EepromEntryDef, error) {
+    if err := e.identify(); err != nil { return nil, err }
+    switch {
+        case e.tpe == ETH_MODULE_SFF_8472 || e.tpe == ETH_MODULE_SFF_8079:
+            // A2h fields are beyond EEPROM of SFF-8079 and so skipped
+            return txrEepromTable, nil
+        case e.cmis:
+            return cmisEepromStatic[:], nil
+        default:
+            return nil, e.unsupported()
+    }
+}
+
+// ValidateTable returns description of every field enabled by flags that does not fit in module EEPROM,
+// such fields are silently skipped by moduleInfo. A2h fields of modules without A2h page are not reported.
+func (e *EthToolModule) ValidateTable(flags int) []string {
+    table, err := e.staticTable()
+    if err != nil { return nil }
+    var ret []string
+    for _, def := range(table) {
+        if def.flag & flags == 0 || def.offset + def.length <= e.eeprom_len {
+            continue
+        }
+        if def.offset >= 0x100 && e.eeprom_len <= 0x100 {
+            continue
+        }
+        ret = append(ret, fmt.Sprintf("field %s (0x%02x-0x%02x) is beyond EEPROM length 0x%02x",
+                                      def.name, def.offset, def.offset + def.length, e.eeprom_len))
+    }
+    return ret
+}
+
+func (e *EthToolModule) moduleInfo(flags int) (map[string]string, error) {
+    table, err := e.staticTable()
+    if err != nil { return nil, err }
+    return e.readTable(table, flags)
+}
+
+// readTable reads and decodes fields of table enabled by flags
+func (e *EthToolModule) readTable(table []EepromEntryDef, flags int) (map[string]string, error) {
+    ret := make(map[string]string)
+    var failed []string // ranges that could not be read
+    var plan   []string // all read ranges, for debugging of GAP_MERGE
+    var lastErr error
+    succeeded := 0
+    query := make([]bufferInfo, len(table))
+    var query_start uint32 = 0
+    var query_end   uint32 = 0
+    query_len   := 0
+    for i, qdef := range(table) {
+        // fmt.Printf("Outer loop[%d] %s (offset:0x%02x)\n", i, qdef.name, qdef.offset)
+        // written without subtraction, offset - GAP_MERGE would wrap around for fields near offset 0
+        if query_len > 0 && qdef.offset > query_end + GAP_MERGE {
+            // fmt.Printf("  Querying: query_len:%d query_start:0x%02x query_end:0x%02x\n", query_len, query_start, query_end)
+            buf, err := e.Read(query_start, query_end - query_start)
+            plan = append(plan, fmt.Sprintf("0x%02x-0x%02x", query_start, query_end))
+            if err != nil || uint32(len(buf)) < query_end - query_start {
+                // keep fields from other blocks, this one is just reported
+                if err == nil { err = errors.New("ethtool: Short read.") }
+                failed = append(failed, fmt.Sprintf("0x%02x-0x%02x", query_start, query_end))
+                lastErr = err
+                query_len = 0
+            }
+            if query_len > 0 {
+                succeeded ++
+            }
+            for j:=0; j<query_len; j++ {
+                ddef    := table[query[j].def]
+                buf_pos := query[j].buf_pos
+                buf_end := buf_pos + ddef.length
+                // fmt.Printf("  Decoding query[%d] name:%s offset:0x%02x len:0x%02x buf_pos:0x%02x buf_end:0x%02x decoder:%d\n",
+                //              j, ddef.name, ddef.offset, ddef.length, buf_pos, buf_end, ddef.decoder)
+                ret[ddef.name] = decodeStatic(buf[buf_pos:buf_end], ddef.decoder)
+                // fmt.Printf("    ->'%s'\n",ret[ddef.name])
+            }
+            query_len = 0
+        }
+        if qdef.flag & flags != 0 && qdef.offset + qdef.length <= e.eeprom_len {
+            if query_len == 0 {
+                query_start = qdef.offset
+            }
+            query[query_len].buf_pos = qdef.offset - query_start
+            query[query_len].def = i
+            // fmt.Printf("  Adding query[%d] %s offset:0x%02x len:0x%02x at [%d] with buf_pos:0x%02x\n",
+            //           i, qdef.name, qdef.offset, qdef.length, query_len, query[query_len].buf_pos)
+            query_len ++
+            query_end = qdef.offset + qdef.length
+        }
+    }
+    if e.Debug {
+        fmt.Printf("Read plan of %s: %d reads %s\n", e.Name(), len(plan), strings.Join(plan, " "))
+    }
+    if len(failed) > 0 {
+        if succeeded == 0 {
+            return nil, lastErr
+        }
+        ret["partial_read"] = strings.Join(failed, ",")
+    }
+    resolveBitrate(ret)
+    checkBounds(ret)
+    //fmt.Printf("RET:")
+    //for k, v := range(ret) { fmt.Printf(" %s:'%s'", k, v) }
+    //fmt.Printf("\n")
+    return ret, nil
+}
+
+// planTable returns ranges readTable reads for flags, fields closer than GAP_MERGE are read together
+func (e *EthToolModule) planTable(table []EepromEntryDef, flags int) []string {
+    var plan []string
+    var start, end uint32
+    open := false
+    for _, def := range(table) {
+        if open && def.offset > end + GAP_MERGE {
+            plan = append(plan, fmt.Sprintf("0x%02x-0x%02x", start, end))
+            open = false
+        }
+        if def.flag & flags != 0 && def.offset + def.length <= e.eeprom_len {
+            if !open {
+                start = def.offset
+                open = true
+            }
+            end = def.offset + def.length
+        }
+    }
+    return plan
+}
+
+// ReadPlan returns ranges ModuleInfo(flags) reads on the first scrape and on scrapes that find module info
+// (and identifier) in cache, reading only identifier. Plans of unsupported module hold just the identifier.
+func (e *EthToolModule) ReadPlan(flags int) ([]string, []string, error) {
+    var ident []string
+    if e.driverLen > 0 {
+        ident = []string{"0x00-0x01"}
+    }
+    table, err := e.staticTable()
+    if err != nil { return ident, ident, err }
+    if flags & TXR_MI_CACHE == 0 || ModuleCacheDisabled {
+        plan := append(append([]string{}, ident...), e.planTable(table, flags)...)
+        return plan, plan, nil
+    }
+    flags = flags &^ TXR_MI_CACHE
+    serial := e.planTable(table, TXR_MI_SERIAL)
+    first  := append(append(append([]string{}, ident...), serial...), e.planTable(table, flags &^ TXR_MI_SERIAL)...)
+    cached := append(append([]string{}, serial...), e.planTable(table, uncachedFlags(flags))...)
+    return first, cached, nil
+}
+
+// BaseIdentityPlan returns ranges read by BaseIdentity
+func (e *EthToolModule) BaseIdentityPlan() []string {
+    if err := e.identify(); err != nil { return nil }
+    switch e.tpe {
+        case ETH_MODULE_SFF_8636, ETH_MODULE_SFF_8436:
+            return e.planTable(qsfpBaseIdentity[:], TXR_MI_ALL)
+        default:
+            return e.planTable(sfpBaseIdentity[:], TXR_MI_ALL)
+    }
+}
+
+// DiagReads returns number of reads done by TxrDiag
+func (e *EthToolModule) DiagReads() int {
+    e.identify()
+    if e.tpe != ETH_MODULE_SFF_8472 || e.eeprom_len <= 0x160 {
+        return 0
+    }
+    if AuxMonitorsEnabled {
+        return 2
+    }
+    return 1
+}
+
+// tagBounds are sane ranges of numeric tags, 0 means unspecified. Values outside of range
+// come from garbage reads (or from passive cables, that use wavelen bytes for cable compliance).
+var tagBounds = map[string]struct{ min, max int }{
+    "wavelen": { 200, 2000 },    // nm
+    "bitrate": { 0,   60000 },   // Mbps, SFP56 has ~53 Gb/s, erased EEPROM (0xff, extended 0xff) decodes as 63750
+}
+
+// BoundedTags returns names of tags that are checked against sane bounds, see "suspect" tag
+func BoundedTags() []string {
+    ret := make([]string, 0, len(tagBounds))
+    for name := range(tagBounds) {
+        ret = append(ret, name)
+    }
+    sort.Strings(ret)
+    return ret
+}
+
+// checkBounds removes tags outside of their tagBounds and lists them in "suspect" tag
+func checkBounds(ret map[string]string) {
+    var suspect []string
+    for name, bounds := range(tagBounds) {
+        value, found := ret[name]
+        if !found {
+            continue
+        }
+        n, err := strconv.Atoi(value)
+        if err == nil && (n == 0 || (n >= bounds.min && n <= bounds.max)) {
+            continue
+        }
+        delete(ret, name)
+        suspect = append(suspect, name)
+    }
+    if len(suspect) > 0 {
+        sort.Strings(suspect)
+        ret["suspect"] = strings.Join(suspect, ",")
+    }
+}
+
+var moduleCache = make(map[string]map[string]string)
+var moduleCacheMutex sync.Mutex // interfaces are collected by parallel goroutines
+
+// FlushModuleCache forgets all cached module info, it is read again on next scrape
+func FlushModuleCache() {
+    moduleCacheMutex.Lock()
+    defer moduleCacheMutex.Unlock()
+    moduleCache = make(map[string]map[string]string)
+    identifierCache = make(map[string]identifierEntry)
+}
+
+// ModuleCacheEntries returns number of optics whose module info is cached
+func ModuleCacheEntries() int {
+    moduleCacheMutex.Lock()
+    defer moduleCacheMutex.Unlock()
+    return len(moduleCache)
+}
+
+// ModuleCacheDisabled makes ModuleInfo always read EEPROM, e.g. when optics with duplicate serials are in use
+var ModuleCacheDisabled bool
+
+// cacheFields are names of fields kept in module cache, nil means all of them
+var cacheFields map[string]bool
+
+// SetCacheFields restricts module cache to given fields, the others are read on every call of ModuleInfo.
+// Custom fields have to be added by AddEepromField before.
+func SetCacheFields(names []string) error {
+    fields := make(map[string]bool)
+    for _, name := range(names) {
+        found := false
+        for _, def := range(txrEepromTable) {
+            if def.name == name && def.length > 0 {
+                found = true
+            }
+        }
+        if !found {
+            return fmt.Errorf("Field '%s' is not an EEPROM field, it cannot be cached", name)
+        }
+        fields[name] = true
+    }
+    cacheFields = fields
+    return nil
+}
+
+// cacheable returns whether field is kept in module cache
+func cacheable(name string) bool {
+    return cacheFields == nil || cacheFields[name] || name == "serial"
+}
+
+// uncachedFlags returns flags of fields that have to be read even when module info is found in cache
+func uncachedFlags(flags int) int {
+    if cacheFields == nil {
+        return 0
+    }
+    ret := 0
+    for _, def := range(txrEepromTable) {
+        if def.flag & flags != 0 && !cacheable(def.name) {
+            ret = ret | def.flag
+        }
+    }
+    return ret
+}
+
+// PowerDecibels converts optical power to decibels relative to reference power, both in mW
+// (i.e. dBm for ref_mW 1, dBµW for ref_mW 0.001). Power of 0 mW is -Inf, callers exporting it have to skip it.
+func PowerDecibels(mW, ref_mW float64) float64 {
+    return math.Log10(mW / ref_mW)*10.0
+}
+
+func (e *EthToolModule) ModuleInfo(flags int) (map[string]string, error) {
+    if ModuleCacheDisabled {
+        return e.moduleInfo(flags)
+    }
+    if err := e.identify(); err != nil { return nil, err }
+    var sn string
+    have_sn := false
+    cache := flags & TXR_MI_CACHE != 0
+    if e.idCached && !cache {
+        // serial is not read, so cached identifier cannot be checked
+        if err := e.readIdentifier(); err != nil { return nil, err }
+    }
+    flags = flags &^ TXR_MI_CACHE
+    if cache {
+        // when serial cannot be read, try to read at least the other fields without cache
+        serial, _ := e.moduleInfo(TXR_MI_SERIAL)
+        sn, have_sn = serial["serial"]
+        if e.idCached && (!have_sn || sn != e.idSerial) {
+            // module was replaced, its serial may even be elsewhere
+            moduleCacheMutex.Lock()
+            delete(identifierCache, e.Name())
+            moduleCacheMutex.Unlock()
+            if err := e.readIdentifier(); err != nil { return nil, err }
+            return e.ModuleInfo(flags | TXR_MI_CACHE)
+        }
+        if !e.idCached && e.identifier >= 0 && have_sn && ValidSerial(sn) && e.Abandoned() == nil {
+            moduleCacheMutex.Lock()
+            identifierCache[e.Name()] = identifierEntry{ identifier: byte(e.identifier), serial: sn }
+            moduleCacheMutex.Unlock()
+        }
+        if have_sn && ValidSerial(sn) {
+            moduleCacheMutex.Lock()
+            cached, found := moduleCache[sn]
+            moduleCacheMutex.Unlock()
+            if found {
+                // caller may add its own tags, do not let it modify the cache
+                ret := make(map[string]string)
+                if fresh := uncachedFlags(flags); fresh != 0 {
+                    var err error
+                    ret, err = e.moduleInfo(fresh)
+                    if (err != nil) { return nil, err }
+                }
+                for k, v := range cached {
+                    ret[k] = v
+                }
+                return ret, nil
+            }
+        }
+    }
+    if have_sn {
+        flags = flags &^ TXR_MI_SERIAL
+    }
+    ret, err := e.moduleInfo(flags)
+    if (err != nil) { return nil, err }
+    if have_sn && ret["partial_read"] == "" && e.Abandoned() == nil {
+        // this is TXR_MI_CACHE branch, partial result is read again next time
+        ret["serial"] = sn
+        retcopy := make(map[string]string)
+        for k, v := range ret {
+            if cacheable(k) {
+                retcopy[k] = v
+            }
+        }
+        moduleCacheMutex.Lock()
+        moduleCache[sn] = retcopy
+        moduleCacheMutex.Unlock()
+    }
+    return ret, nil
+}
+
+// ModuleIdentity is typed form of identity tags returned by ModuleInfo
+type ModuleIdentity struct {
+    Vendor   string
+    OUI      string
+    Product  string
+    Revision string
+    Wavelen  int       // nm, 0 when missing
+    Serial   string
+    MfgDate  time.Time // zero when missing or invalid, see ParseMfgDate
+}
+
+// NewModuleIdentity converts identity tags, fields not present in tags are left zero
+func NewModuleIdentity(tags map[string]string) ModuleIdentity {
+    wavelen, _ := strconv.Atoi(tags["wavelen"])
+    mfgdate, _ := ParseMfgDate(tags["mfgdate"])
+    return ModuleIdentity{
+        Vendor:   tags["vendor"],
+        OUI:      tags["oui"],
+        Product:  tags["product"],
+        Revision: tags["revision"],
+        Wavelen:  wavelen,
+        Serial:   tags["serial"],
+        MfgDate:  mfgdate,
+    }
+}
+
+// Identity reads identity fields like ModuleInfo(TXR_MI_ALLOW_CACHE) and returns them typed
+func (e *EthToolModule) Identity() (ModuleIdentity, error) {
+    tags, err := e.ModuleInfo(TXR_MI_ALLOW_CACHE)
+    if err != nil { return ModuleIdentity{}, err }
+    return NewModuleIdentity(tags), nil
+}
@@ -0,0 +1,297 @@
+package sff8472
+// vim: set et sw=4 :
+
+import (
+    "fmt"
+    "math"
+    "reflect"
+    "testing"
+)
+
+// serialField pads serial to 16 bytes of A0h bytes 68-83 with given padding
+func serialField(serial string, padding byte) []byte {
+    field := make([]byte, 16)
+    for i := range(field) {
+        field[i] = padding
+    }
+    copy(field, serial)
+    return field
+}
+
+func TestFromLatin1(t *testing.T) {
+    tests := []struct {
+        name   string
+        input  []byte
+        expect string
+    }{
+        { "space padding",       serialField("FNS12345", 0x20),              "FNS12345" },
+        { "NUL padding",         serialField("FNS12345", 0x00),              "FNS12345" },
+        { "0xFF padding",        serialField("FNS12345", 0xff),              "FNS12345" },
+        { "garbage after NUL",   []byte("FNS12345\x00\x41\x42\x43\x20\xff"), "FNS12345" },
+        { "mixed padding",       []byte("FNS12345 \xff \xff\x00\x00"),       "FNS12345" },
+        { "inner space kept",    []byte("AB CD   "),                         "AB CD" },
+        { "inner 0xFF kept",     []byte("AB\xffCD  "),                       "ABÿCD" },
+        { "Latin-1 character",   []byte("Caf\xe9    "),                      "Café" },
+        { "leading NUL",         []byte("\x00FNS12345"),                     "" },
+        { "all padding",         serialField("", 0xff),                      "" },
+        { "empty",               []byte{},                                   "" },
+    }
+    for _, test := range(tests) {
+        if got := fromLatin1(test.input); got != test.expect {
+            t.Errorf("%s: fromLatin1(%q) = %q, expected %q", test.name, test.input, got, test.expect)
+        }
+    }
+}
+
+func TestValidSerial(t *testing.T) {
+    tests := []struct {
+        serial string
+        expect bool
+    }{
+        { fromLatin1(serialField("FNS12345", 0x20)), true },
+        { fromLatin1(serialField("FNS12345", 0x00)), true },
+        { fromLatin1(serialField("FNS12345", 0xff)), true },
+        { "abcd",          true },  // lowercase letters are alphanumeric too
+        { "ab-cd",         true },
+        { "abc",           false }, // too short
+        { "12-3",          false },
+        { "--------",      false },
+        { "",              false },
+        { "FNS1234ÿ", false }, // 0xFF inside serial
+        { "FNS\x0112345",  false }, // control character
+    }
+    for _, test := range(tests) {
+        if got := ValidSerial(test.serial); got != test.expect {
+            t.Errorf("ValidSerial(%q) = %v, expected %v", test.serial, got, test.expect)
+        }
+    }
+}
+
+// fakeModule returns module whose reads are served from eeprom and counted
+func fakeModule(eeprom []byte, reads *[]string) *EthToolModule {
+    return &EthToolModule{
+        tpe:        ETH_MODULE_SFF_8472,
+        eeprom_len: uint32(len(eeprom)),
+        identified: true,
+        reader: func(offset uint32, length uint32) ([]byte, error) {
+            *reads = append(*reads, fmt.Sprintf("0x%02x-0x%02x", offset, offset + length))
+            return eeprom[offset:offset + length], nil
+        },
+    }
+}
+
+func TestReadTableGapMerge(t *testing.T) {
+    eeprom := make([]byte, 256)
+    copy(eeprom[0x10:], "ABCD")
+    tests := []struct {
+        gap    uint32
+        expect []string
+    }{
+        { 0,             []string{"0x10-0x18"} },
+        { GAP_MERGE - 1, []string{fmt.Sprintf("0x10-0x%02x", 0x18 + GAP_MERGE - 1)} },
+        { GAP_MERGE,     []string{fmt.Sprintf("0x10-0x%02x", 0x18 + GAP_MERGE)} },
+        { GAP_MERGE + 1, []string{"0x10-0x14", fmt.Sprintf("0x%02x-0x%02x", 0x14 + GAP_MERGE + 1, 0x18 + GAP_MERGE + 1)} },
+    }
+    for _, test := range(tests) {
+        second := uint32(0x14) + test.gap
+        copy(eeprom[second:], "WXYZ")
+        table := []EepromEntryDef{
+            { name: "first",    offset: 0x10,   length: 4, flag: TXR_MI_VENDOR, decoder: txr_DECODE_STRING },
+            { name: "second",   offset: second, length: 4, flag: TXR_MI_VENDOR, decoder: txr_DECODE_STRING },
+            { name: "--last--", offset: infty,  length: 0, flag: 0,             decoder: 0 },
+        }
+        var reads []string
+        m := fakeModule(eeprom, &reads)
+        if plan := m.planTable(table, TXR_MI_VENDOR); !reflect.DeepEqual(plan, test.expect) {
+            t.Errorf("gap %d: planned %v, expected %v", test.gap, plan, test.expect)
+        }
+        tags, err := m.readTable(table, TXR_MI_VENDOR)
+        if err != nil {
+            t.Fatalf("gap %d: %v", test.gap, err)
+        }
+        if !reflect.DeepEqual(reads, test.expect) {
+            t.Errorf("gap %d: reads %v, expected %v", test.gap, reads, test.expect)
+        }
+        if tags["first"] != "ABCD" || tags["second"] != "WXYZ" {
+            t.Errorf("gap %d: decoded %v", test.gap, tags)
+        }
+        copy(eeprom[second:], "\x00\x00\x00\x00")
+    }
+}
+
+func TestReadTableBounds(t *testing.T) {
+    tests := []struct {
+        name    string
+        wavelen []byte // A0h bytes 60-61
+        bitrate byte   // A0h byte 12
+        ext     byte   // A0h byte 66
+        expect  map[string]string
+    }{
+        { "in range",           []byte{0x05, 0x1e}, 0x67, 0x00, map[string]string{"wavelen": "1310", "bitrate": "10300"} },
+        { "extended bitrate",   []byte{0x05, 0x1e}, 0xff, 0x64, map[string]string{"wavelen": "1310", "bitrate": "25000"} },
+        { "SFP56 bitrate",      []byte{0x05, 0x1e}, 0xff, 0xd5, map[string]string{"wavelen": "1310", "bitrate": "53250"} },
+        { "erased bitrate",     []byte{0x05, 0x1e}, 0xff, 0xff, map[string]string{"wavelen": "1310", "suspect": "bitrate"} },
+        { "unspecified",        []byte{0x00, 0x00}, 0x00, 0x00, map[string]string{"wavelen": "0",    "bitrate": "0"} },
+        { "wavelen too long",   []byte{0xfd, 0xe8}, 0x67, 0x00, map[string]string{"bitrate": "10300", "suspect": "wavelen"} },
+        { "wavelen too short",  []byte{0x00, 0x55}, 0x0d, 0x00, map[string]string{"bitrate": "1300",  "suspect": "wavelen"} },
+    }
+    for _, test := range(tests) {
+        eeprom := make([]byte, 256)
+        copy(eeprom[0x3c:], test.wavelen)
+        eeprom[0x0c] = test.bitrate
+        eeprom[0x42] = test.ext
+        var reads []string
+        tags, err := fakeModule(eeprom, &reads).readTable(txrEepromTable, TXR_MI_WAVELEN | TXR_MI_COMPLIANCE)
+        if err != nil {
+            t.Fatalf("%s: %v", test.name, err)
+        }
+        for _, name := range([]string{"wavelen", "bitrate", "bitrate_ext", "suspect"}) {
+            if tags[name] != test.expect[name] {
+                t.Errorf("%s: %s is '%s', expected '%s'", test.name, name, tags[name], test.expect[name])
+            }
+        }
+    }
+}
+
+func TestCheckBounds(t *testing.T) {
+    tests := []struct {
+        tags   map[string]string
+        expect map[string]string
+    }{
+        { map[string]string{"wavelen": "850",   "bitrate": "60000"},   map[string]string{"wavelen": "850", "bitrate": "60000"} },
+        { map[string]string{"wavelen": "65000", "bitrate": "60001"},   map[string]string{"suspect": "bitrate,wavelen"} },
+        { map[string]string{"wavelen": "199",   "bitrate": "-100"},    map[string]string{"suspect": "bitrate,wavelen"} },
+        { map[string]string{"wavelen": "2001",  "bitrate": "garbage"}, map[string]string{"suspect": "bitrate,wavelen"} },
+        { map[string]string{"bitrate": "extended"},                    map[string]string{"suspect": "bitrate"} },
+        { map[string]string{"vendor": "ACME"},                         map[string]string{"vendor": "ACME"} },
+    }
+    for _, test := range(tests) {
+        tags := make(map[string]string)
+        for k, v := range(test.tags) {
+            tags[k] = v
+        }
+        checkBounds(tags)
+        if !reflect.DeepEqual(tags, test.expect) {
+            t.Errorf("checkBounds(%v) = %v, expected %v", test.tags, tags, test.expect)
+        }
+    }
+}
+
+func TestSetCacheFields(t *testing.T) {
+    defer func() { cacheFields = nil }()
+    tests := []struct {
+        names []string
+        valid bool
+    }{
+        { []string{"vendor", "product", "wavelen"}, true },
+        { []string{"rx_power_low_warn"},           true },
+        { []string{"vendor", "partial_read"},      false },
+        { []string{"alias"},                       false },
+        { []string{"suspect"},                     false },
+        { []string{"ALL"},                         false },
+        { []string{"CACHE"},                       false },
+        { []string{"--last--"},                    false },
+        { []string{"no_such_field"},               false },
+    }
+    for _, test := range(tests) {
+        if err := SetCacheFields(test.names); (err == nil) != test.valid {
+            t.Errorf("SetCacheFields(%v) returned %v", test.names, err)
+        }
+    }
+}
+
+func TestIdentifierCache(t *testing.T) {
+    defer FlushModuleCache()
+    eeprom := make([]byte, 256)
+    eeprom[0] = 0x03 // SFP in QSFP cage (i.e. via adapter)
+    copy(eeprom[0x44:], serialField("FNS1", ' '))
+    var reads []string
+    open := func() *EthToolModule {
+        // as NewEthToolModule for driver reporting QSFP+ cage
+        m := fakeModule(eeprom, &reads)
+        copy(m.ifname[:], "test0")
+        m.driverTpe, m.driverLen, m.identified = ETH_MODULE_SFF_8636, 256, false
+        m.tpe, m.eeprom_len = m.driverTpe, m.driverLen
+        return m
+    }
+    tests := []struct {
+        name      string
+        id        byte
+        serial    string
+        expectId  bool // identifier is read
+        expectTpe uint32
+    }{
+        { "first",    0x03, "FNS1", true,  ETH_MODULE_SFF_8472 },
+        { "cached",   0x03, "FNS1", false, ETH_MODULE_SFF_8472 },
+        { "replaced", 0x18, "FNS2", true,  ETH_MODULE_SFF_8636 }, // QSFP-DD (CMIS)
+    }
+    for _, test := range(tests) {
+        eeprom[0] = test.id
+        copy(eeprom[0x44:], serialField(test.serial, ' '))
+        reads = nil
+        m := open()
+        if len(reads) != 0 {
+            t.Errorf("%s: %v read on open", test.name, reads)
+        }
+        if _, err := m.ModuleInfo(TXR_MI_SERIAL | TXR_MI_CACHE); err != nil {
+            t.Fatalf("%s: %v", test.name, err)
+        }
+        idRead := false
+        for _, read := range(reads) {
+            idRead = idRead || read == "0x00-0x01"
+        }
+        if idRead != test.expectId {
+            t.Errorf("%s: identifier read %v, expected %v (reads %v)", test.name, idRead, test.expectId, reads)
+        }
+        if m.Type() != test.expectTpe {
+            t.Errorf("%s: type %d, expected %d", test.name, m.Type(), test.expectTpe)
+        }
+    }
+}
+
+func TestPowerDecibels(t *testing.T) {
+    tests := []struct {
+        mW, ref float64
+        expect  float64
+    }{
+        { 1,      1,     0 },   // dBm
+        { 0.5,    1,     -3.0103 },
+        { 2,      1,     3.0103 },
+        { 0.0001, 1,     -40 }, // resolution of SFF-8472 power
+        { 1,      0.001, 30 },  // dBµW
+        { 0.02,   0.1,   -6.9897 }, // margin above threshold
+        { 0,      1,     math.Inf(-1) },
+    }
+    for _, test := range(tests) {
+        got := PowerDecibels(test.mW, test.ref)
+        if math.IsInf(test.expect, 0) {
+            if got != test.expect {
+                t.Errorf("PowerDecibels(%v, %v) = %v, expected %v", test.mW, test.ref, got, test.expect)
+            }
+        } else if math.Abs(got - test.expect) > 0.0001 {
+            t.Errorf("PowerDecibels(%v, %v) = %v, expected %v", test.mW, test.ref, got, test.expect)
+        }
+    }
+}
+
+func TestMfgdateFlag(t *testing.T) {
+    defer func() { cacheFields = nil }()
+    wavelen, _ := GetTxrInfoFlags([]string{"wavelen"})
+    mfgdate, _ := GetTxrInfoFlags([]string{"mfgdate"})
+    if wavelen != TXR_MI_WAVELEN || mfgdate != TXR_MI_DATE {
+        t.Errorf("flags of wavelen 0x%x and mfgdate 0x%x, expected 0x%x and 0x%x", wavelen, mfgdate, TXR_MI_WAVELEN, TXR_MI_DATE)
+    }
+    // uncached mfgdate does not make wavelen read on every scrape, nor the other way round
+    if err := SetCacheFields([]string{"wavelen"}); err != nil {
+        t.Fatal(err)
+    }
+    if fresh := uncachedFlags(TXR_MI_WAVELEN | TXR_MI_DATE); fresh != TXR_MI_DATE {
+        t.Errorf("uncached flags 0x%x with cached wavelen, expected 0x%x", fresh, TXR_MI_DATE)
+    }
+    if err := SetCacheFields([]string{"mfgdate"}); err != nil {
+        t.Fatal(err)
+    }
+    if fresh := uncachedFlags(TXR_MI_WAVELEN | TXR_MI_DATE); fresh != TXR_MI_WAVELEN {
+        t.Errorf("uncached flags 0x%x with cached mfgdate, expected 0x%x", fresh, TXR_MI_WAVELEN)
+    }
+}
@@ -0,0 +1,209 @@
+package sff8472
+// vim: set et sw=4 :
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "sync"
+    "unsafe"
+
+    "golang.org/x/sys/unix"
+)
+
+// attributes of ethtool netlink MODULE_EEPROM_GET (linux 5.13), golang.org/x/sys has only the message
+const (
+    ethtool_A_MODULE_EEPROM_HEADER      = 1
+    ethtool_A_MODULE_EEPROM_OFFSET      = 2
+    ethtool_A_MODULE_EEPROM_LENGTH      = 3
+    ethtool_A_MODULE_EEPROM_PAGE        = 4
+    ethtool_A_MODULE_EEPROM_BANK        = 5
+    ethtool_A_MODULE_EEPROM_I2C_ADDRESS = 6
+    ethtool_A_MODULE_EEPROM_DATA        = 7
+
+    EEPROM_HALF_PAGE = 128 // netlink reads must not cross half page boundary
+    eeprom_I2C_ADDRESS = 0x50 // A0h, CMIS and SFF-8636 have all pages there
+)
+
+// nativeEndian is byte order of netlink headers and attributes
+var nativeEndian binary.ByteOrder = binary.LittleEndian
+
+func init() {
+    probe := uint16(1)
+    if *(*byte)(unsafe.Pointer(&probe)) == 0 {
+        nativeEndian = binary.BigEndian
+    }
+}
+
+var ethtoolFamily uint16 // generic netlink family id, 0 until resolved
+var ethtoolFamilyMutex sync.Mutex
+
+// nlAttr encodes netlink attribute padded to 4 bytes
+func nlAttr(tpe uint16, payload []byte) []byte {
+    length := unix.SizeofNlAttr + len(payload)
+    ret := make([]byte, (length + unix.NLA_ALIGNTO - 1) &^ (unix.NLA_ALIGNTO - 1))
+    nativeEndian.PutUint16(ret[0:2], uint16(length))
+    nativeEndian.PutUint16(ret[2:4], tpe)
+    copy(ret[unix.SizeofNlAttr:], payload)
+    return ret
+}
+
+func nlAttrU32(tpe uint16, value uint32) []byte {
+    payload := make([]byte, 4)
+    nativeEndian.PutUint32(payload, value)
+    return nlAttr(tpe, payload)
+}
+
+// parseNlAttrs returns payloads of attributes by type, nested flag is stripped
+func parseNlAttrs(buf []byte) map[uint16][]byte {
+    ret := make(map[uint16][]byte)
+    for len(buf) >= unix.SizeofNlAttr {
+        length := int(nativeEndian.Uint16(buf[0:2]))
+        if length < unix.SizeofNlAttr || length > len(buf) {
+            break
+        }
+        ret[nativeEndian.Uint16(buf[2:4]) &^ unix.NLA_F_NESTED] = buf[unix.SizeofNlAttr:length]
+        aligned := (length + unix.NLA_ALIGNTO - 1) &^ (unix.NLA_ALIGNTO - 1)
+        if aligned > len(buf) {
+            break
+        }
+        buf = buf[aligned:]
+    }
+    return ret
+}
+
+// genlRequest sends single generic netlink request and returns attributes of its reply
+func genlRequest(family uint16, cmd uint8, attrs []byte) (map[uint16][]byte, error) {
+    var fd int
+    var err error
+    if EthToolNetns != "" {
+        fd, err = socketInNetns(EthToolNetns, unix.AF_NETLINK, unix.SOCK_RAW | unix.SOCK_CLOEXEC, unix.NETLINK_GENERIC)
+    } else {
+        fd, err = unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW | unix.SOCK_CLOEXEC, unix.NETLINK_GENERIC)
+    }
+    if err != nil { return nil, err }
+    defer unix.Close(fd)
+    if err := unix.Bind(fd, &unix.SockaddrNetlink{ Family: unix.AF_NETLINK }); err != nil {
+        return nil, err
+    }
+
+    // nlmsghdr, genlmsghdr (cmd, version 1, reserved), attributes
+    msg := make([]byte, unix.SizeofNlMsghdr + 4, unix.SizeofNlMsghdr + 4 + len(attrs))
+    msg = append(msg, attrs...)
+    nativeEndian.PutUint32(msg[0:4], uint32(len(msg)))
+    nativeEndian.PutUint16(msg[4:6], family)
+    nativeEndian.PutUint16(msg[6:8], unix.NLM_F_REQUEST)
+    nativeEndian.PutUint32(msg[8:12], 1)
+    msg[unix.SizeofNlMsghdr] = cmd
+    msg[unix.SizeofNlMsghdr + 1] = 1
+    if err := unix.Sendto(fd, msg, 0, &unix.SockaddrNetlink{ Family: unix.AF_NETLINK }); err != nil {
+        return nil, err
+    }
+
+    buf := make([]byte, 8192)
+    n, _, err := unix.Recvfrom(fd, buf, 0)
+    if err != nil { return nil, err }
+    if n < unix.SizeofNlMsghdr {
+        return nil, errors.New("netlink: Short reply.")
+    }
+    length := int(nativeEndian.Uint32(buf[0:4]))
+    if length > n || length < unix.SizeofNlMsghdr {
+        return nil, errors.New("netlink: Truncated reply.")
+    }
+    if nativeEndian.Uint16(buf[4:6]) == unix.NLMSG_ERROR {
+        if length < unix.SizeofNlMsghdr + 4 {
+            return nil, errors.New("netlink: Short error reply.")
+        }
+        if errno := int32(nativeEndian.Uint32(buf[unix.SizeofNlMsghdr:])); errno != 0 {
+            return nil, unix.Errno(-errno)
+        }
+        return nil, errors.New("netlink: Unexpected acknowledgement.")
+    }
+    if length < unix.SizeofNlMsghdr + 4 {
+        return nil, errors.New("netlink: Short reply.")
+    }
+    return parseNlAttrs(buf[unix.SizeofNlMsghdr + 4:length]), nil
+}
+
+// ethtoolFamilyId resolves id of "ethtool" generic netlink family, it is remembered once found
+func ethtoolFamilyId() (uint16, error) {
+    ethtoolFamilyMutex.Lock()
+    defer ethtoolFamilyMutex.Unlock()
+    if ethtoolFamily != 0 {
+        return ethtoolFamily, nil
+    }
+    attrs, err := genlRequest(unix.GENL_ID_CTRL, unix.CTRL_CMD_GETFAMILY,
+                              nlAttr(unix.CTRL_ATTR_FAMILY_NAME, []byte(unix.ETHTOOL_GENL_NAME + "\x00")))
+    if err != nil { return 0, fmt.Errorf("netlink: ethtool family: %v", err) }
+    id, found := attrs[unix.CTRL_ATTR_FAMILY_ID]
+    if !found || len(id) < 2 {
+        return 0, errors.New("netlink: ethtool family: No id in reply.")
+    }
+    ethtoolFamily = nativeEndian.Uint16(id)
+    return ethtoolFamily, nil
+}
+
+// pageChunk is one netlink read of ReadPage, it does not cross half page boundary
+type pageChunk struct {
+    bank, page     uint8
+    offset, length uint32
+}
+
+// pageChunks splits read into half pages, lower half is read as page 0 of bank 0
+func pageChunks(bank, page uint8, offset, length uint32) []pageChunk {
+    var ret []pageChunk
+    end := offset + length
+    for offset < end {
+        chunkEnd := (offset / EEPROM_HALF_PAGE + 1) * EEPROM_HALF_PAGE
+        if chunkEnd > end {
+            chunkEnd = end
+        }
+        chunk := pageChunk{ bank, page, offset, chunkEnd - offset }
+        if offset < EEPROM_HALF_PAGE {
+            chunk.bank, chunk.page = 0, 0
+        }
+        ret = append(ret, chunk)
+        offset = chunkEnd
+    }
+    return ret
+}
+
+// pageRequest encodes attributes of MODULE_EEPROM_GET request reading chunk of module of device dev
+func pageRequest(dev string, chunk pageChunk) []byte {
+    attrs := nlAttr(ethtool_A_MODULE_EEPROM_HEADER | unix.NLA_F_NESTED,
+                    nlAttr(unix.ETHTOOL_A_HEADER_DEV_NAME, []byte(dev + "\x00")))
+    attrs = append(attrs, nlAttrU32(ethtool_A_MODULE_EEPROM_OFFSET, chunk.offset)...)
+    attrs = append(attrs, nlAttrU32(ethtool_A_MODULE_EEPROM_LENGTH, chunk.length)...)
+    attrs = append(attrs, nlAttr(ethtool_A_MODULE_EEPROM_PAGE, []byte{chunk.page})...)
+    attrs = append(attrs, nlAttr(ethtool_A_MODULE_EEPROM_BANK, []byte{chunk.bank})...)
+    attrs = append(attrs, nlAttr(ethtool_A_MODULE_EEPROM_I2C_ADDRESS, []byte{eeprom_I2C_ADDRESS})...)
+    return attrs
+}
+
+// ReadPage reads module EEPROM over ethtool netlink, which unlike Read can address CMIS banks and pages.
+// Offset is within 256 bytes of lower memory and selected upper page, i.e. 0x80 is first byte of page.
+// Lower memory (offset < 0x80) is the same for all pages, it is read as page 0 of bank 0, as kernel requires.
+// Requires linux 5.13 and driver implementing get_module_eeprom_by_page.
+func (e *EthToolModule) ReadPage(bank, page uint8, offset, length uint32) ([]byte, error) {
+    // offset + length could overflow
+    if length > 2 * EEPROM_HALF_PAGE || offset > 2 * EEPROM_HALF_PAGE - length {
+        return nil, errors.New("ethtool: Offset out of bounds.")
+    }
+    family, err := ethtoolFamilyId()
+    if err != nil { return nil, err }
+    ret := make([]byte, 0, length)
+    for _, chunk := range(pageChunks(bank, page, offset, length)) {
+        e.Throttle.Wait()
+        if err := e.Abandoned(); err != nil {
+            return nil, err
+        }
+        reply, err := genlRequest(family, unix.ETHTOOL_MSG_MODULE_EEPROM_GET, pageRequest(e.Name(), chunk))
+        if err != nil { return nil, err }
+        data := reply[ethtool_A_MODULE_EEPROM_DATA]
+        if uint32(len(data)) < chunk.length {
+            return append(ret, data...), errors.New("ethtool: Short read.")
+        }
+        ret = append(ret, data[:chunk.length]...)
+    }
+    return ret, nil
+}
@@ -0,0 +1,143 @@
+package sff8472
+// vim: set et sw=4 :
+
+import (
+    "bytes"
+    "reflect"
+    "testing"
+
+    "golang.org/x/sys/unix"
+)
+
+func TestNlAttr(t *testing.T) {
+    tests := []struct {
+        payload []byte
+        size    int // padded to 4 bytes
+    }{
+        { []byte{},           4 },
+        { []byte("a"),        8 },
+        { []byte("abc"),      8 },
+        { []byte("abcd"),     8 },
+        { []byte("eth0\x00"), 12 },
+    }
+    for _, test := range(tests) {
+        attr := nlAttr(7, test.payload)
+        if len(attr) != test.size {
+            t.Errorf("%q: attribute has %d bytes, expected %d", test.payload, len(attr), test.size)
+            continue
+        }
+        if length := nativeEndian.Uint16(attr[0:2]); int(length) != unix.SizeofNlAttr + len(test.payload) {
+            t.Errorf("%q: length %d excludes payload or includes padding", test.payload, length)
+        }
+        if tpe := nativeEndian.Uint16(attr[2:4]); tpe != 7 {
+            t.Errorf("%q: type %d, expected 7", test.payload, tpe)
+        }
+        if !bytes.Equal(attr[unix.SizeofNlAttr:unix.SizeofNlAttr + len(test.payload)], test.payload) {
+            t.Errorf("%q: payload encoded as %q", test.payload, attr[unix.SizeofNlAttr:])
+        }
+        for _, pad := range(attr[unix.SizeofNlAttr + len(test.payload):]) {
+            if pad != 0 {
+                t.Errorf("%q: padding is not zeroed: %v", test.payload, attr)
+            }
+        }
+    }
+    if value := nativeEndian.Uint32(nlAttrU32(2, 0x12345678)[unix.SizeofNlAttr:]); value != 0x12345678 {
+        t.Errorf("nlAttrU32 encoded 0x%x", value)
+    }
+}
+
+func TestParseNlAttrs(t *testing.T) {
+    inner := nlAttr(unix.ETHTOOL_A_HEADER_DEV_NAME, []byte("eth0\x00"))
+    var buf []byte
+    buf = append(buf, nlAttr(1 | unix.NLA_F_NESTED, inner)...)
+    buf = append(buf, nlAttrU32(2, 0x80)...)
+    buf = append(buf, nlAttr(4, []byte{3})...)
+    buf = append(buf, nlAttr(7, []byte("abcde"))...)
+    expect := map[uint16][]byte{
+        1: inner,
+        2: nlAttrU32(2, 0x80)[unix.SizeofNlAttr:],
+        4: []byte{3},
+        7: []byte("abcde"),
+    }
+    if attrs := parseNlAttrs(buf); !reflect.DeepEqual(attrs, expect) {
+        t.Errorf("parsed %v, expected %v", attrs, expect)
+    }
+    if attrs := parseNlAttrs(buf[:len(buf) - 4]); !reflect.DeepEqual(attrs, map[uint16][]byte{1: inner, 2: expect[2], 4: expect[4]}) {
+        t.Errorf("attribute truncated by end of message was parsed: %v", attrs)
+    }
+    // last attribute without its padding is still complete
+    if attrs := parseNlAttrs(buf[:len(buf) - 3]); !bytes.Equal(attrs[7], []byte("abcde")) {
+        t.Errorf("unpadded last attribute parsed as %q", attrs[7])
+    }
+    short := []byte{2, 0, 5, 0, 0, 0, 0, 0}
+    if attrs := parseNlAttrs(short); len(attrs) != 0 {
+        t.Errorf("attribute with length shorter than its header was parsed: %v", attrs)
+    }
+    if attrs := parseNlAttrs(nil); len(attrs) != 0 {
+        t.Errorf("empty message parsed as %v", attrs)
+    }
+}
+
+func TestPageChunks(t *testing.T) {
+    tests := []struct {
+        offset, length uint32
+        expect         []pageChunk
+    }{
+        { 0x00, 0x80,  []pageChunk{ {0, 0, 0x00, 0x80} } },
+        { 0x80, 0x80,  []pageChunk{ {1, 0x11, 0x80, 0x80} } },
+        { 0x10, 0x20,  []pageChunk{ {0, 0, 0x10, 0x20} } },
+        { 0x90, 0x08,  []pageChunk{ {1, 0x11, 0x90, 0x08} } },
+        { 0x7f, 0x02,  []pageChunk{ {0, 0, 0x7f, 0x01}, {1, 0x11, 0x80, 0x01} } },
+        { 0x00, 0x100, []pageChunk{ {0, 0, 0x00, 0x80}, {1, 0x11, 0x80, 0x80} } },
+        { 0x40, 0,     nil },
+    }
+    for _, test := range(tests) {
+        if chunks := pageChunks(1, 0x11, test.offset, test.length); !reflect.DeepEqual(chunks, test.expect) {
+            t.Errorf("0x%02x+0x%02x split to %v, expected %v", test.offset, test.length, chunks, test.expect)
+        }
+    }
+}
+
+func TestPageRequest(t *testing.T) {
+    attrs := parseNlAttrs(pageRequest("eth0", pageChunk{ 1, 0x11, 0x90, 0x08 }))
+    header := parseNlAttrs(attrs[ethtool_A_MODULE_EEPROM_HEADER])
+    if dev := string(header[unix.ETHTOOL_A_HEADER_DEV_NAME]); dev != "eth0\x00" {
+        t.Errorf("header names device %q", dev)
+    }
+    u32 := func(tpe uint16) uint32 {
+        if len(attrs[tpe]) != 4 {
+            t.Fatalf("attribute %d has %d bytes", tpe, len(attrs[tpe]))
+        }
+        return nativeEndian.Uint32(attrs[tpe])
+    }
+    if offset, length := u32(ethtool_A_MODULE_EEPROM_OFFSET), u32(ethtool_A_MODULE_EEPROM_LENGTH); offset != 0x90 || length != 0x08 {
+        t.Errorf("request reads 0x%02x+0x%02x, expected 0x90+0x08", offset, length)
+    }
+    for tpe, expect := range(map[uint16][]byte{
+        ethtool_A_MODULE_EEPROM_BANK:        {1},
+        ethtool_A_MODULE_EEPROM_PAGE:        {0x11},
+        ethtool_A_MODULE_EEPROM_I2C_ADDRESS: {eeprom_I2C_ADDRESS},
+    }) {
+        if !bytes.Equal(attrs[tpe], expect) {
+            t.Errorf("attribute %d is %v, expected %v", tpe, attrs[tpe], expect)
+        }
+    }
+}
+
+func TestReadPageBounds(t *testing.T) {
+    m := &EthToolModule{}
+    tests := []struct {
+        offset, length uint32
+    }{
+        { 0x00,       0x101 },
+        { 0x100,      0x01 },
+        { 0xff,       0x02 },
+        { 0xffffffff, 0x02 }, // offset + length overflows to 1
+        { 0x02,       0xffffffff },
+    }
+    for _, test := range(tests) {
+        if _, err := m.ReadPage(0, 0, test.offset, test.length); err == nil || err.Error() != "ethtool: Offset out of bounds." {
+            t.Errorf("ReadPage(0x%x, 0x%x) returned %v", test.offset, test.length, err)
+        }
+    }
+}
@@ -0,0 +1,107 @@
+package main
+// vim: set et sw=4 :
+
+import (
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/ebikt/ethtool-exporter/sff8472"
+)
+
+// timestampedEmiter is an Emiter that can attach collection time of replayed records
+type timestampedEmiter interface {
+    At(t time.Time) Emiter
+}
+
+// ifaceRecord is result of collection of single interface
+type ifaceRecord struct {
+    iface   string
+    err     error
+    tags    map[string]string
+    metrics *sff8472.TranscieverDiagnostics
+    link    *LinkInfo
+    time    time.Time
+}
+
+// Snapshot is an Emiter that remembers last collected result of every interface.
+// It is filled by background scraping and replayed on request.
+type Snapshot struct {
+    mutex   sync.Mutex
+    records map[string]*ifaceRecord
+    stats   ScrapeStats // of last background scrape
+}
+
+func NewSnapshot() *Snapshot {
+    return &Snapshot{ records: make(map[string]*ifaceRecord) }
+}
+
+func (s *Snapshot) Emit(iface string, err error, tags map[string]string, metrics *sff8472.TranscieverDiagnostics, link *LinkInfo) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    s.records[iface] = &ifaceRecord{
+        iface:   iface,
+        err:     err,
+        tags:    tags,
+        metrics: metrics,
+        link:    link,
+        time:    time.Now(),
+    }
+}
+
+func (s *Snapshot) SetStats(stats ScrapeStats) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    s.stats = stats
+}
+
+// Expire forgets interfaces that were not collected during last maxAge
+// (i.e. they no longer match device globs), so they become stale in prometheus.
+func (s *Snapshot) Expire(maxAge time.Duration) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    now := time.Now()
+    for iface, record := range(s.records) {
+        if now.Sub(record.time) > maxAge {
+            delete(s.records, iface)
+        }
+    }
+}
+
+// Get returns last record of interface
+func (s *Snapshot) Get(iface string) (*ifaceRecord, bool) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    record, found := s.records[iface]
+    return record, found
+}
+
+// Records returns current records sorted by interface name
+func (s *Snapshot) Records() []*ifaceRecord {
+    s.mutex.Lock()
+    ret := make([]*ifaceRecord, 0, len(s.records))
+    for _, record := range(s.records) {
+        ret = append(ret, record)
+    }
+    s.mutex.Unlock()
+    sort.Slice(ret, func(i, j int) bool { return naturalLess(ret[i].iface, ret[j].iface) })
+    return ret
+}
+
+// Replay emits remembered records not older than maxAge, returns statistics of last scrape
+func (s *Snapshot) Replay(ch Emiter, maxAge time.Duration) ScrapeStats {
+    now := time.Now()
+    for _, record := range(s.Records()) {
+        if now.Sub(record.time) > maxAge {
+            continue
+        }
+        if tch, ok := ch.(timestampedEmiter); ok {
+            tch.At(record.time).Emit(record.iface, record.err, record.tags, record.metrics, record.link)
+        } else {
+            ch.Emit(record.iface, record.err, record.tags, record.metrics, record.link)
+        }
+    }
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    return s.stats
+}
@@ -0,0 +1,106 @@
+package main
+// vim: set et sw=4 :
+
+import (
+    "fmt"
+    "math"
+    "net"
+    "os"
+    "regexp"
+    "strconv"
+    "strings"
+    "sync"
+
+    "github.com/ebikt/ethtool-exporter/sff8472"
+)
+
+// statsdMaxPacket keeps UDP datagrams within ethernet MTU
+const statsdMaxPacket = 1432
+
+// statsdTagChars are not allowed in dogstatsd tag values
+var statsdTagChars = regexp.MustCompile(`[,|#:[:cntrl:][:space:]]`)
+
+// StatsDChan sends gauges with dogstatsd tags, i.e. "ethtool.transciever.temperature_C:45|g|#iface:enp1s0f0".
+// Lines are batched into packets, call Flush after collection.
+type StatsDChan struct {
+    mutex  sync.Mutex // interfaces are emitted by parallel goroutines
+    conn   net.Conn
+    packet []byte
+}
+
+func NewStatsDChan(address string) (*StatsDChan, error) {
+    conn, err := net.Dial("udp", address)
+    if err != nil { return nil, err }
+    return &StatsDChan{ conn: conn, packet: make([]byte, 0, statsdMaxPacket) }, nil
+}
+
+func (sc *StatsDChan) Emit(iface string, err error, tags map[string]string, metrics *sff8472.TranscieverDiagnostics, link *LinkInfo) {
+    tagList := []string{"iface:" + statsdTagChars.ReplaceAllString(iface, "_")}
+    for _, label := range(transcieverTags()) {
+        if value := tags[label]; value != "" {
+            tagList = append(tagList, label + ":" + statsdTagChars.ReplaceAllString(value, "_"))
+        }
+    }
+    tagStr := strings.Join(tagList, ",")
+    gauges := map[string]float64{ "present": boolGauge(err == nil) }
+    if err == nil && metrics != nil {
+        gauges["temperature_C"]      = metrics.TemperatureC
+        if metrics.Has(sff8472.DIAG_VOLTAGE) {
+            gauges["voltage_V"]      = metrics.VoltageV
+        }
+        if metrics.Has(sff8472.DIAG_BIAS) {
+            gauges["bias_A"]         = metrics.BiasMA * 0.001
+        }
+        if metrics.Has(sff8472.DIAG_RX_POWER) {
+            gauges["receive_power_W"]   = metrics.ReceiveMW * 0.001
+            gauges["receive_power_dBm"] = metrics.ReceiveDBm
+        }
+        if metrics.Has(sff8472.DIAG_TX_POWER) {
+            gauges["transmit_power_W"]   = metrics.TransmitMW * 0.001
+            gauges["transmit_power_dBm"] = metrics.TransmitDBm
+        }
+    }
+    sc.mutex.Lock()
+    defer sc.mutex.Unlock()
+    for name, value := range(gauges) {
+        if math.IsInf(value, 0) || math.IsNaN(value) {
+            // i.e. dark receiver in dBm, statsd has no representation for it
+            continue
+        }
+        sc.add(fmt.Sprintf("%s.transciever.%s:%s|g|#%s", namespace, name, strconv.FormatFloat(value, 'f', -1, 64), tagStr))
+    }
+}
+
+func (sc *StatsDChan) EmitStats(stats ScrapeStats) {
+    sc.mutex.Lock()
+    defer sc.mutex.Unlock()
+    sc.add(fmt.Sprintf("%s.exporter.interfaces_discovered:%d|g", namespace, stats.discovered))
+    sc.add(fmt.Sprintf("%s.exporter.interfaces_collected:%d|g", namespace, stats.collected))
+}
+
+// add appends line to packet, packet is sent first when the line would not fit in it
+func (sc *StatsDChan) add(line string) {
+    if len(sc.packet) > 0 && len(sc.packet) + 1 + len(line) > statsdMaxPacket {
+        sc.send()
+    }
+    if len(sc.packet) > 0 {
+        sc.packet = append(sc.packet, '\n')
+    }
+    sc.packet = append(sc.packet, line...)
+}
+
+func (sc *StatsDChan) send() {
+    if _, err := sc.conn.Write(sc.packet); err != nil {
+        fmt.Fprintf(os.Stderr, "Error: statsd: %v\n", err)
+    }
+    sc.packet = sc.packet[:0]
+}
+
+// Flush sends the last incomplete packet
+func (sc *StatsDChan) Flush() {
+    sc.mutex.Lock()
+    defer sc.mutex.Unlock()
+    if len(sc.packet) > 0 {
+        sc.send()
+    }
+}
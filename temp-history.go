@@ -0,0 +1,96 @@
+package main
+// vim: set et sw=4 :
+
+import (
+    "sync"
+
+    "github.com/ebikt/ethtool-exporter/sff8472"
+)
+
+const tempEmaAlpha = 0.1 // weight of the newest sample in exponential moving average
+
+type tempStat struct {
+    ema  float64
+    peak float64
+}
+
+// TempHistory keeps temperature statistics of transcievers across scrapes.
+// It is keyed by serial number, so it survives interface renaming.
+type TempHistory struct {
+    mutex  sync.Mutex
+    stats  map[string]*tempStat
+    owners opticOwners
+}
+
+func NewTempHistory() *TempHistory {
+    return &TempHistory{
+        stats:  make(map[string]*tempStat),
+        owners: newOpticOwners(),
+    }
+}
+
+// opticOwners tracks which interface holds which optic (see historyKey), to forget statistics of replaced optic
+type opticOwners struct {
+    keys   map[string]string // iface -> key
+    ifaces map[string]string // key -> iface that saw it last
+}
+
+func newOpticOwners() opticOwners {
+    return opticOwners{ keys: make(map[string]string), ifaces: make(map[string]string) }
+}
+
+// claim records that iface holds optic with key. It returns key of optic that was replaced in iface,
+// or "" when there is none or when that optic was meanwhile seen in another interface (it was moved there).
+func (o opticOwners) claim(iface, key string) string {
+    old, found := o.keys[iface]
+    o.keys[iface] = key
+    o.ifaces[key] = iface
+    if !found || old == key || o.ifaces[old] != iface {
+        return ""
+    }
+    delete(o.ifaces, old)
+    return old
+}
+
+// historyKey identifies optic by serial, falls back to interface name when serial is unusable
+func historyKey(iface string, tags map[string]string) string {
+    if sn := tags["serial"]; sff8472.ValidSerial(sn) {
+        return "sn:" + sn
+    }
+    return "iface:" + iface
+}
+
+func (h *TempHistory) Update(iface string, tags map[string]string, temp float64) {
+    key := historyKey(iface, tags)
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+    if old := h.owners.claim(iface, key); old != "" {
+        // optic was replaced, start over
+        delete(h.stats, old)
+    }
+    stat, found := h.stats[key]
+    if !found {
+        h.stats[key] = &tempStat{ ema: temp, peak: temp }
+        return
+    }
+    stat.ema = stat.ema + tempEmaAlpha * (temp - stat.ema)
+    if temp > stat.peak {
+        stat.peak = temp
+    }
+}
+
+func (h *TempHistory) Get(iface string, tags map[string]string) (tempStat, bool) {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+    stat, found := h.stats[historyKey(iface, tags)]
+    if !found { return tempStat{}, false }
+    return *stat, true
+}
+
+// Flush forgets statistics of all optics, they start over on next scrape
+func (h *TempHistory) Flush() {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+    h.stats = make(map[string]*tempStat)
+    h.owners = newOpticOwners()
+}
@@ -0,0 +1,56 @@
+package main
+// vim: set et sw=4 :
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "os"
+    "sync"
+    "text/template"
+
+    "github.com/ebikt/ethtool-exporter/sff8472"
+)
+
+// templateData is passed to -output-template for every interface
+type templateData struct {
+    Iface   string
+    Error   string // empty when scrape succeeded
+    Tags    map[string]string
+    Metrics *sff8472.TranscieverDiagnostics // nil without diagnostics, i.e. {{.Metrics.TemperatureC}}
+}
+
+// ParseOutputTemplate validates template given by -output-template
+func ParseOutputTemplate(text string) (*template.Template, error) {
+    return template.New("output").Option("missingkey=zero").Parse(text)
+}
+
+// TemplateChan is an Emiter that writes template executed for every interface, followed by newline
+type TemplateChan struct {
+    mutex  sync.Mutex // interfaces are emitted by parallel goroutines
+    tmpl   *template.Template
+    writer io.Writer
+}
+
+func NewTemplateChan(tmpl *template.Template, writer io.Writer) *TemplateChan {
+    return &TemplateChan{ tmpl: tmpl, writer: writer }
+}
+
+func (tc *TemplateChan) Emit(iface string, err error, tags map[string]string, metrics *sff8472.TranscieverDiagnostics, link *LinkInfo) {
+    data := templateData{ Iface: iface, Tags: tags, Metrics: metrics }
+    if err != nil {
+        data.Error = err.Error()
+    }
+    tc.mutex.Lock()
+    defer tc.mutex.Unlock()
+    if terr := tc.tmpl.Execute(tc.writer, data); terr != nil {
+        fmt.Fprintf(os.Stderr, "Error: %s: %v\n", iface, terr)
+    }
+    fmt.Fprintln(tc.writer)
+}
+
+// Template scrapes all interfaces and writes them using template, error of interface discovery is returned
+func (e *Exporter) Template(ctx context.Context, tmpl *template.Template, writer io.Writer) error {
+    _, err := e.CollectTo(ctx, NewTemplateChan(tmpl, writer))
+    return err
+}